@@ -0,0 +1,223 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminEndpoints are the paths served by the AdminHandler, relative to where it is mounted
+var adminEndpoints = []string{"connections", "stats", "kick", "broadcast", "debug"}
+
+/*
+ConnectionInfo describes an active connection in the admin API.
+*/
+type ConnectionInfo struct {
+	ID               string    `json:"id"`
+	RemoteAddr       string    `json:"remote_addr"`
+	UserID           string    `json:"user_id,omitempty"`
+	Codec            string    `json:"codec"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	MessagesReceived int64     `json:"messages_received"`
+	MessagesSent     int64     `json:"messages_sent"`
+	Subscriptions    []string  `json:"subscriptions"`
+}
+
+/*
+EnableAdmin serves the AdminHandler under the prefix, next to the websocket endpoint.
+
+	wsServer := server.New("8080").EnableAll().EnableAdmin("/admin", websockets.BearerToken(func(token string) (*websockets.Principal, error) {
+		if token != os.Getenv("ADMIN_TOKEN") {
+			return nil, websockets.ErrUnauthorized
+		}
+		return &websockets.Principal{UserID: "admin"}, nil
+	}))
+*/
+func (s *WsServer) EnableAdmin(prefix string, auth Authenticator) *WsServer {
+	handler := s.AdminHandler(auth)
+	for _, endpoint := range adminEndpoints {
+		s.serveHTTPPath(path.Join(prefix, endpoint), handler)
+	}
+	return s
+}
+
+/*
+AdminHandler returns an http.Handler to inspect and manage the connections, routed by the last path segment
+
+	GET  .../connections                           the active connections as a list of ConnectionInfo
+	GET  .../stats                                 the server Stats
+	POST .../kick?id=<client id>&code=4000&reason= closes the connection, the code defaults to 1008 policy violation
+	POST .../broadcast                             sends {"type": "maintenance", "payload": ...} to every client
+	GET  .../debug                                 {"debug": false}
+	POST .../debug?enabled=true                    turns debug logging on or off
+
+Every request must be accepted by auth, which is separate from the websocket Authenticator. A nil auth rejects
+every request.
+*/
+func (s *WsServer) AdminHandler(auth Authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorizeAdmin(w, r, auth) {
+			return
+		}
+
+		switch endpoint := path.Base(r.URL.Path); {
+		case endpoint == "connections" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, s.Connections())
+		case endpoint == "stats" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, s.Stats())
+		case endpoint == "kick" && r.Method == http.MethodPost:
+			s.adminKick(w, r)
+		case endpoint == "broadcast" && r.Method == http.MethodPost:
+			s.adminBroadcast(w, r)
+		case endpoint == "debug" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]bool{"debug": s.debugEnabled()})
+		case endpoint == "debug" && r.Method == http.MethodPost:
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			s.SetDebug(enabled)
+			log.Printf("Admin set debug to %t", enabled)
+			writeJSON(w, http.StatusOK, map[string]bool{"debug": enabled})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (s *WsServer) authorizeAdmin(w http.ResponseWriter, r *http.Request, auth Authenticator) bool {
+	var err error = ErrUnauthorized
+	if auth != nil {
+		var principal *Principal
+		if principal, err = auth.Authenticate(r); err == nil && principal == nil {
+			err = ErrUnauthorized
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		status = authErr.Status
+	}
+	log.Printf("Rejected admin request from %s: %v", r.RemoteAddr, err)
+	http.Error(w, http.StatusText(status), status)
+	return false
+}
+
+/*
+Connections returns the active connections sorted by the time they connected.
+*/
+func (s *WsServer) Connections() []ConnectionInfo {
+	clients := s.clients()
+	connections := make([]ConnectionInfo, 0, len(clients))
+
+	s.topicsMu.RLock()
+	for _, client := range clients {
+		info := ConnectionInfo{
+			ID:               client.ID,
+			RemoteAddr:       client.Conn.RemoteAddr().String(),
+			Codec:            client.Codec.Name(),
+			ConnectedAt:      client.connectedAt,
+			MessagesReceived: atomic.LoadInt64(&client.messagesReceived),
+			MessagesSent:     atomic.LoadInt64(&client.messagesSent),
+			Subscriptions:    make([]string, 0, len(client.topics)),
+		}
+		if client.Principal != nil {
+			info.UserID = client.Principal.UserID
+		}
+		for pattern := range client.topics {
+			info.Subscriptions = append(info.Subscriptions, pattern)
+		}
+		sort.Strings(info.Subscriptions)
+		connections = append(connections, info)
+	}
+	s.topicsMu.RUnlock()
+
+	sort.Slice(connections, func(i, j int) bool { return connections[i].ConnectedAt.Before(connections[j].ConnectedAt) })
+	return connections
+}
+
+func (s *WsServer) adminKick(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	client, ok := s.Client(query.Get("id"))
+	if !ok {
+		http.Error(w, ErrClientNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	code := websocket.ClosePolicyViolation
+	if value := query.Get("code"); value != "" {
+		var err error
+		if code, err = strconv.Atoi(value); err != nil || !validCloseCode(code) {
+			http.Error(w, "code must be a websocket close code that can be sent", http.StatusBadRequest)
+			return
+		}
+	}
+	reason := query.Get("reason")
+	if len(reason) > 123 {
+		http.Error(w, "reason must be at most 123 bytes", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin kicked client %s with %d %q", client.ID, code, reason)
+	client.disconnect(code, reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validCloseCode reports whether the code may be sent in a close frame, RFC 6455 reserves 1004-1006 and 1015
+// and leaves 1016-2999 unassigned
+func validCloseCode(code int) bool {
+	switch {
+	case code >= websocket.CloseNormalClosure && code <= websocket.CloseUnsupportedData:
+	case code >= websocket.CloseInvalidFramePayloadData && code <= 1014: // bad gateway
+	case code >= 3000 && code <= 4999:
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *WsServer) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var msg struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.Type == "" {
+		http.Error(w, `the body must be {"type": "...", "payload": ...}`, http.StatusBadRequest)
+		return
+	}
+
+	delivered := 0
+	for _, client := range s.clients() {
+		payload, err := transcode(msg.Payload, JSONCodec{}, client.Codec)
+		if err == nil {
+			err = client.WriteEnvelope(&Envelope{Type: msg.Type, Payload: payload})
+		}
+		if err != nil {
+			log.Printf("Failed to send admin message to a client: %v", err)
+			continue
+		}
+		delivered++
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"delivered": delivered})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminHandler(t *testing.T) {
+	s := New("0").EnableTopics().EnableAdmin("/admin", BearerToken(func(token string) (*Principal, error) {
+		if token != "secret" {
+			return nil, ErrUnauthorized
+		}
+		return &Principal{UserID: "admin"}, nil
+	}))
+	ts := newTestServer(t, s)
+
+	conn := ts.dial("")
+	conn.WriteJSON(Envelope{Type: "subscribe", Metadata: map[string]string{"topic": "chat.*"}})
+	var ack Envelope
+	conn.ReadJSON(&ack)
+
+	admin := func(method, path, body string, v interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.httpURL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+
+	if resp, _ := http.Get(ts.httpURL + "/admin/stats"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d", resp.StatusCode)
+	}
+
+	var connections []ConnectionInfo
+	admin(http.MethodGet, "/admin/connections", "", &connections)
+	if len(connections) != 1 || connections[0].MessagesReceived != 1 || connections[0].MessagesSent != 1 ||
+		len(connections[0].Subscriptions) != 1 || connections[0].Subscriptions[0] != "chat.*" {
+		t.Fatalf("connections = %+v", connections)
+	}
+
+	var stats Stats
+	admin(http.MethodGet, "/admin/stats", "", &stats)
+	if stats.ActiveConnections != 1 || stats.MessagesReceived != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	var debug map[string]bool
+	admin(http.MethodPost, "/admin/debug?enabled=true", "", &debug)
+	if !debug["debug"] || !s.debugEnabled() {
+		t.Fatalf("debug was not enabled")
+	}
+
+	var delivered map[string]int
+	admin(http.MethodPost, "/admin/broadcast", `{"type": "maintenance", "payload": {"in": "5m"}}`, &delivered)
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "maintenance" || string(env.Payload) != `{"in":"5m"}` || delivered["delivered"] != 1 {
+		t.Fatalf("broadcast = %+v %v, delivered %v", env, err, delivered)
+	}
+
+	// Reserved and unassigned codes must not be sent
+	for _, code := range []string{"999", "1005", "1006", "1015", "2000", "5000"} {
+		if status := admin(http.MethodPost, "/admin/kick?id="+connections[0].ID+"&code="+code, "", nil); status != http.StatusBadRequest {
+			t.Fatalf("kick with code %s status = %d", code, status)
+		}
+	}
+	if status := admin(http.MethodPost, "/admin/kick?id="+connections[0].ID+"&code=4001&reason=banned", "", nil); status != http.StatusNoContent {
+		t.Fatalf("kick status = %d", status)
+	}
+	var closeErr *websocket.CloseError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != 4001 || closeErr.Text != "banned" {
+		t.Fatalf("ReadMessage error = %v", err)
+	}
+	if status := admin(http.MethodPost, "/admin/kick?id=missing", "", nil); status != http.StatusNotFound {
+		t.Fatalf("kick missing status = %d", status)
+	}
+}
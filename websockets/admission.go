@@ -0,0 +1,140 @@
+package websockets
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+AdmissionConfig caps the connections the server accepts. Zero values do not limit.
+
+MaxConnections and AcceptRate are server wide and reject with 503 Service Unavailable, MaxPerIP and MaxPerUser
+reject with 429 Too Many Requests. MaxPerUser only applies to clients with a Principal.
+
+MaxPerIP counts connections by the same remote address as RateLimitConfig.PerIP.
+*/
+type AdmissionConfig struct {
+	MaxConnections int
+	MaxPerIP       int
+	MaxPerUser     int
+	// AcceptRate limits how fast new connections are upgraded
+	AcceptRate RateLimit
+	// RetryAfter is sent in the Retry-After header when a connection limit is reached, 5 seconds by default.
+	// Requests over the AcceptRate are told when the next upgrade is allowed instead.
+	RetryAfter time.Duration
+}
+
+/*
+Admission limits the connections accepted by the server. Requests over a limit are rejected with a Retry-After
+header before the connection is upgraded, and counted in the server stats.
+
+	wsServer := server.New("8080").EnableAll().Admission(websockets.AdmissionConfig{
+		MaxConnections: 10000,
+		MaxPerIP:       20,
+		MaxPerUser:     5,
+		AcceptRate:     websockets.RateLimit{Rate: 100, Burst: 500},
+	})
+*/
+func (s *WsServer) Admission(config AdmissionConfig) *WsServer {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = 5 * time.Second
+	}
+	a := &admission{config: config, perIP: make(map[string]int), perUser: make(map[string]int)}
+	if config.AcceptRate.enabled() {
+		a.accept = newTokenBucket(config.AcceptRate)
+	}
+	s.admission = a
+	return s
+}
+
+// admission counts the admitted connections, a slot is taken before the upgrade and released with the Client
+type admission struct {
+	mu      sync.Mutex
+	config  AdmissionConfig
+	accept  *tokenBucket
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+}
+
+// admissionError is the HTTP response for a rejected upgrade
+type admissionError struct {
+	status     int
+	retryAfter time.Duration
+	reason     string
+}
+
+func (e *admissionError) Error() string {
+	return "connection rejected: " + e.reason
+}
+
+// admit takes a slot for the request, it must be released with release if the upgrade fails
+func (a *admission) admit(ip, userID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.config
+	switch {
+	case c.MaxConnections > 0 && a.total >= c.MaxConnections:
+		return &admissionError{http.StatusServiceUnavailable, c.RetryAfter, "too many connections"}
+	case c.MaxPerIP > 0 && a.perIP[ip] >= c.MaxPerIP:
+		return &admissionError{http.StatusTooManyRequests, c.RetryAfter, "too many connections from " + ip}
+	case c.MaxPerUser > 0 && userID != "" && a.perUser[userID] >= c.MaxPerUser:
+		return &admissionError{http.StatusTooManyRequests, c.RetryAfter, "too many connections for user " + userID}
+	}
+	if !a.accept.allow(time.Now()) {
+		return &admissionError{http.StatusServiceUnavailable, time.Duration(float64(time.Second) / c.AcceptRate.Rate), "accept rate exceeded"}
+	}
+
+	a.total++
+	a.perIP[ip]++
+	if userID != "" {
+		a.perUser[userID]++
+	}
+	return nil
+}
+
+func (a *admission) release(ip, userID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.total--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+	if userID == "" {
+		return
+	}
+	if a.perUser[userID]--; a.perUser[userID] <= 0 {
+		delete(a.perUser, userID)
+	}
+}
+
+// admit checks the request against the AdmissionConfig, answering it when it is rejected
+func (s *WsServer) admit(w http.ResponseWriter, r *http.Request, principal *Principal) (release func(), err error) {
+	if s.admission == nil {
+		return func() {}, nil
+	}
+
+	ip := remoteIP(r.RemoteAddr)
+	var userID string
+	if principal != nil {
+		userID = principal.UserID
+	}
+
+	if err := s.admission.admit(ip, userID); err != nil {
+		rejected := err.(*admissionError)
+		log.Printf("Rejected connection from %s: %v", r.RemoteAddr, err)
+		s.counter.IncrementAdmissionRejections()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejected.retryAfter.Seconds()))))
+		http.Error(w, http.StatusText(rejected.status), rejected.status)
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { s.admission.release(ip, userID) }) }, nil
+}
@@ -0,0 +1,44 @@
+package websockets
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	s := New("0").Admission(AdmissionConfig{MaxConnections: 2, MaxPerUser: 1}).Authenticate(userAuthenticator())
+	ts := newTestServer(t, s)
+
+	reject := func(user string, status int) {
+		t.Helper()
+		if resp := ts.reject(user); resp.StatusCode != status || resp.Header.Get("Retry-After") != "5" {
+			t.Fatalf("Dial %s = %v, want %d with Retry-After", user, resp, status)
+		}
+	}
+
+	u1 := ts.dial("u1")
+	reject("u1", http.StatusTooManyRequests)
+	ts.dial("u2")
+	reject("u3", http.StatusServiceUnavailable)
+
+	u1.Close()
+	for len(s.clients()) == 2 {
+		time.Sleep(time.Millisecond)
+	}
+	ts.dial("u3")
+
+	if stats := s.Stats(); stats.AdmissionRejects != 2 {
+		t.Fatalf("AdmissionRejects = %d, want 2", stats.AdmissionRejects)
+	}
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	s := New("0").Admission(AdmissionConfig{AcceptRate: RateLimit{Rate: 0.5, Burst: 1}})
+	ts := newTestServer(t, s)
+	ts.dial("").Close()
+
+	if resp := ts.reject(""); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("Dial = %v, want 503 with Retry-After 2", resp)
+	}
+}
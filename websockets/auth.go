@@ -0,0 +1,230 @@
+package websockets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Principal is the authenticated identity of a Client.
+
+It is stored on the Client and available to every handler
+
+	func(ctx context.Context, client *websockets.Client, msg *websockets.Envelope) error {
+		log.Printf("message from %s", client.Principal.UserID)
+	}
+*/
+type Principal struct {
+	UserID string
+	Claims map[string]interface{}
+}
+
+/*
+Authenticator is invoked with the HTTP request before it is upgraded.
+
+Returning an error rejects the upgrade. An *AuthError controls the HTTP status code,
+any other error is rejected with 401 Unauthorized.
+*/
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+// TokenValidator resolves a credential such as a bearer token or session cookie to a Principal
+type TokenValidator func(token string) (*Principal, error)
+
+// AuthError rejects an upgrade with the given HTTP status code
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+var (
+	// ErrNoCredentials is returned by the built-in Authenticators when the request does not carry their credential
+	ErrNoCredentials = &AuthError{Status: http.StatusUnauthorized, Message: "missing credentials"}
+	ErrUnauthorized  = &AuthError{Status: http.StatusUnauthorized, Message: "unauthorized"}
+	ErrForbidden     = &AuthError{Status: http.StatusForbidden, Message: "forbidden"}
+)
+
+/*
+Authenticate sets the Authenticator invoked before every upgrade.
+
+	wsServer := server.New("8080").EnableAll().Authenticate(
+		websockets.AnyOf(
+			websockets.BearerToken(validateJWT),
+			websockets.QueryParam("access_token", validateJWT),
+		),
+	)
+*/
+func (s *WsServer) Authenticate(authenticator Authenticator) *WsServer {
+	s.authenticator = authenticator
+	return s
+}
+
+// authenticate runs the Authenticator and writes the HTTP error when the request is rejected
+func (s *WsServer) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, error) {
+	if s.authenticator == nil {
+		return nil, nil
+	}
+
+	principal, err := s.authenticator.Authenticate(r)
+	if err == nil && principal == nil {
+		err = ErrUnauthorized
+	}
+	if err != nil {
+		status := http.StatusUnauthorized
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			status = authErr.Status
+		}
+		log.Printf("Rejected connection from %s: %v", r.RemoteAddr, err)
+		s.counter.IncrementAuthRejections()
+		http.Error(w, http.StatusText(status), status)
+		return nil, err
+	}
+	return principal, nil
+}
+
+/*
+AnyOf tries each Authenticator in order and uses the first one that finds credentials on the request.
+
+An Authenticator that returns ErrNoCredentials is skipped, any other error rejects the request.
+*/
+func AnyOf(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(r)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			return principal, err
+		}
+		return nil, ErrNoCredentials
+	})
+}
+
+/*
+BearerToken authenticates requests with an "Authorization: Bearer <token>" header.
+*/
+func BearerToken(validate TokenValidator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		header := r.Header.Get("Authorization")
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || token == "" {
+			return nil, ErrNoCredentials
+		}
+		return validate(token)
+	})
+}
+
+/*
+Cookie authenticates requests with the value of the named cookie.
+*/
+func Cookie(name string, validate TokenValidator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return nil, ErrNoCredentials
+		}
+		return validate(cookie.Value)
+	})
+}
+
+/*
+QueryParam authenticates requests with the value of the named query parameter.
+
+Browsers cannot set headers on websocket requests, so this is the usual way to pass a token from JavaScript
+
+	new WebSocket("wss://example.com/ws?access_token=" + token)
+*/
+func QueryParam(name string, validate TokenValidator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		token := r.URL.Query().Get(name)
+		if token == "" {
+			return nil, ErrNoCredentials
+		}
+		return validate(token)
+	})
+}
+
+/*
+HMACSignedURL authenticates requests to URLs created with SignURL.
+
+The signature covers the path, the user and the expiry so a signed URL cannot be reused for another
+route or after it expires.
+
+	// Issued by the HTTP API to a logged in user
+	signed, err := websockets.SignURL(secret, "wss://example.com/ws", "user-1", time.Now().Add(time.Minute))
+
+	wsServer := server.New("8080").EnableAll().Authenticate(websockets.HMACSignedURL(secret))
+*/
+func HMACSignedURL(secret []byte) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		query := r.URL.Query()
+		userID, expires, signature := query.Get("user"), query.Get("expires"), query.Get("signature")
+		if userID == "" || expires == "" || signature == "" {
+			return nil, ErrNoCredentials
+		}
+
+		expiresAt, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return nil, ErrUnauthorized
+		}
+		if time.Now().Unix() > expiresAt {
+			return nil, &AuthError{Status: http.StatusUnauthorized, Message: "signed url expired"}
+		}
+
+		expected := signURL(secret, r.URL.Path, userID, expires)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil, ErrUnauthorized
+		}
+		return &Principal{UserID: userID}, nil
+	})
+}
+
+/*
+SignURL returns rawURL with the user, expires and signature query parameters accepted by HMACSignedURL.
+*/
+func SignURL(secret []byte, rawURL string, userID string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query := u.Query()
+	query.Set("user", userID)
+	query.Set("expires", exp)
+	query.Set("signature", signURL(secret, path, userID, exp))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func signURL(secret []byte, path, userID, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + userID + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
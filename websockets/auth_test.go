@@ -0,0 +1,69 @@
+package websockets
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+	s := New("0").Authenticate(AnyOf(
+		BearerToken(func(token string) (*Principal, error) {
+			if token != "valid" {
+				return nil, ErrForbidden
+			}
+			return &Principal{UserID: "bearer-user"}, nil
+		}),
+		HMACSignedURL(secret),
+	))
+	Handle(s, "whoami", func(ctx context.Context, client *Client, req NoReply) (string, error) {
+		return client.Principal.UserID, nil
+	})
+
+	ts := newTestServer(t, s)
+	wsURL := ts.url
+
+	expired, _ := SignURL(secret, wsURL, "url-user", time.Now().Add(-time.Minute))
+	signed, _ := SignURL(secret, wsURL, "url-user", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		url    string
+		header http.Header
+		status int
+		user   string
+	}{
+		{"no credentials", wsURL, nil, http.StatusUnauthorized, ""},
+		{"invalid token", wsURL, http.Header{"Authorization": {"Bearer nope"}}, http.StatusForbidden, ""},
+		{"valid token", wsURL, http.Header{"Authorization": {"Bearer valid"}}, http.StatusSwitchingProtocols, "bearer-user"},
+		{"expired url", expired, nil, http.StatusUnauthorized, ""},
+		{"tampered url", strings.Replace(signed, "url-user", "admin", 1), nil, http.StatusUnauthorized, ""},
+		{"signed url", signed, nil, http.StatusSwitchingProtocols, "url-user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, resp, err := ts.connect(tt.url, tt.header)
+			if resp == nil || resp.StatusCode != tt.status {
+				t.Fatalf("got response %v (%v), want status %d", resp, err, tt.status)
+			}
+			if conn == nil {
+				return
+			}
+			defer conn.Close()
+
+			if err := conn.WriteJSON(Envelope{Type: "whoami"}); err != nil {
+				t.Fatalf("WriteJSON: %v", err)
+			}
+			var env Envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				t.Fatalf("ReadJSON: %v", err)
+			}
+			if string(env.Payload) != `"`+tt.user+`"` {
+				t.Fatalf("got principal %s, want %s", env.Payload, tt.user)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package websockets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Broker carries broadcasts and topic publishes between server instances so a message sent on one
+replica reaches the clients connected to all of them.
+
+Publish is called by the handler of the message being forwarded, with a ctx that times out after 5s, and
+must return once ctx is done. Subscribe delivers every message published on the channel, including the
+ones published by the same instance, until ctx is cancelled.
+*/
+type Broker interface {
+	Publish(ctx context.Context, channel string, data []byte) error
+	Subscribe(ctx context.Context, channel string, handler func(data []byte)) error
+}
+
+// DefaultBrokerChannel is the channel servers exchange messages on unless BrokerChannel is set
+const DefaultBrokerChannel = "websockets"
+
+// brokerPublishTimeout bounds forwarding a message, which runs on the handler of the client that sent it
+const brokerPublishTimeout = 5 * time.Second
+
+const (
+	brokerBroadcast = "broadcast"
+	brokerPublish   = "publish"
+)
+
+// brokerMessage is sent between instances, payloads are always JSON so instances can use different Codecs
+type brokerMessage struct {
+	Origin  string          `json:"origin"`
+	Kind    string          `json:"kind"`
+	Topic   string          `json:"topic,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+/*
+Broker fans broadcasts and topic publishes out to every server using the same Broker.
+
+Each server has a random node ID and ignores its own messages, which it has already delivered locally.
+
+	broker := websockets.NewRedisBroker("redis:6379")
+	wsServer, err := server.New("8080").EnableAll().Broker(broker).Start()
+*/
+func (s *WsServer) Broker(broker Broker) *WsServer {
+	return s.BrokerChannel(broker, DefaultBrokerChannel)
+}
+
+/*
+BrokerChannel is Broker using a custom channel, so several clusters can share one Broker.
+*/
+func (s *WsServer) BrokerChannel(broker Broker, channel string) *WsServer {
+	if s.brokerCancel != nil {
+		s.brokerCancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := broker.Subscribe(ctx, channel, s.receiveBrokerMessage); err != nil {
+		log.Printf("Failed to subscribe to broker channel %s: %v", channel, err)
+		cancel()
+		return s
+	}
+	s.broker, s.brokerChannel, s.brokerCancel = broker, channel, cancel
+	log.Printf("Node %s joined broker channel %s", s.nodeID, channel)
+	return s
+}
+
+// newID returns a random identifier for a server instance or a Client
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// forward sends a locally delivered message to the other instances
+func (s *WsServer) forward(kind, topic string, payload func() ([]byte, error)) {
+	if s.broker == nil {
+		return
+	}
+
+	data, err := payload()
+	if err != nil {
+		log.Printf("Failed to encode %s for the broker: %v", kind, err)
+		return
+	}
+	msg, err := json.Marshal(brokerMessage{Origin: s.nodeID, Kind: kind, Topic: topic, Payload: data})
+	if err != nil {
+		log.Printf("Failed to encode %s for the broker: %v", kind, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, brokerPublishTimeout)
+	defer cancel()
+	if err := s.broker.Publish(ctx, s.brokerChannel, msg); err != nil {
+		log.Printf("Failed to forward %s to the broker: %v", kind, err)
+	}
+}
+
+// receiveBrokerMessage delivers a message from another instance to the local clients
+func (s *WsServer) receiveBrokerMessage(data []byte) {
+	var msg brokerMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Failed to decode broker message: %v", err)
+		return
+	}
+	if msg.Origin == s.nodeID {
+		return
+	}
+
+	switch msg.Kind {
+	case brokerBroadcast:
+		var message string
+		if err := json.Unmarshal(msg.Payload, &message); err != nil {
+			log.Printf("Failed to decode broadcast from node %s: %v", msg.Origin, err)
+			return
+		}
+		s.broadcast(message)
+	case brokerPublish:
+		s.publish(msg.Topic, func(codec Codec) ([]byte, error) {
+			return transcode(msg.Payload, JSONCodec{}, codec)
+		})
+	default:
+		log.Printf("Unsupported broker message kind %q from node %s", msg.Kind, msg.Origin)
+	}
+}
+
+/*
+MemoryBroker is a Broker for servers running in the same process, for example in tests.
+
+	broker := websockets.NewMemoryBroker()
+	a := server.New("8080").EnableAll().Broker(broker)
+	b := server.New("8081").EnableAll().Broker(broker)
+*/
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers map[string]map[*memorySubscription]struct{}
+}
+
+type memorySubscription struct {
+	handler func(data []byte)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{handlers: make(map[string]map[*memorySubscription]struct{})}
+}
+
+// Publish calls the handlers subscribed to the channel before returning
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, data []byte) error {
+	b.mu.RLock()
+	subs := make([]*memorySubscription, 0, len(b.handlers[channel]))
+	for sub := range b.handlers[channel] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.handler(data)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, channel string, handler func(data []byte)) error {
+	sub := &memorySubscription{handler: handler}
+
+	b.mu.Lock()
+	if b.handlers[channel] == nil {
+		b.handlers[channel] = make(map[*memorySubscription]struct{})
+	}
+	b.handlers[channel][sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers[channel], sub)
+	}()
+	return nil
+}
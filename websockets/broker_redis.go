@@ -0,0 +1,250 @@
+package websockets
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+RedisBroker is a Broker using Redis pub/sub, speaking the Redis protocol directly.
+
+Publishes share one connection and every Subscribe holds its own. Subscriptions reconnect with
+backoff when the connection drops, messages published while disconnected are lost.
+
+	broker := websockets.NewRedisBroker("redis:6379")
+	broker.Password = os.Getenv("REDIS_PASSWORD")
+*/
+type RedisBroker struct {
+	Addr     string
+	Password string
+	// DialTimeout bounds connecting and authenticating, defaulting to 5s
+	DialTimeout time.Duration
+
+	// publishing holds the token while a publish uses the shared connection, a channel so waiting for it respects the ctx
+	publishing chan struct{}
+	once       sync.Once
+	conn       net.Conn
+	rd         *bufio.Reader
+}
+
+func NewRedisBroker(addr string) *RedisBroker {
+	return &RedisBroker{Addr: addr, DialTimeout: 5 * time.Second}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+/*
+Publish sends data on the channel. It gives up once ctx is done, including while waiting for another publish.
+*/
+func (b *RedisBroker) Publish(ctx context.Context, channel string, data []byte) error {
+	b.once.Do(func() { b.publishing = make(chan struct{}, 1) })
+	select {
+	case b.publishing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-b.publishing }()
+
+	if b.conn == nil {
+		conn, rd, err := b.dial(ctx)
+		if err != nil {
+			return err
+		}
+		b.conn, b.rd = conn, rd
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetDeadline(deadline)
+	} else {
+		b.conn.SetDeadline(time.Time{})
+	}
+
+	_, err := b.conn.Write(encodeRESP("PUBLISH", channel, string(data)))
+	if err == nil {
+		_, err = readRESP(b.rd)
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state, dial again on the next publish
+		b.conn.Close()
+		b.conn, b.rd = nil, nil
+	}
+	return err
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, channel string, handler func(data []byte)) error {
+	conn, rd, err := b.subscribe(ctx, channel)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		backoff := 100 * time.Millisecond
+		for {
+			err := b.receive(ctx, conn, rd, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Redis subscription to %s lost: %v", channel, err)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if conn, rd, err = b.subscribe(ctx, channel); err == nil {
+					backoff = 100 * time.Millisecond
+					break
+				}
+				log.Printf("Failed to resubscribe to %s: %v", channel, err)
+				if backoff *= 2; backoff > 5*time.Second {
+					backoff = 5 * time.Second
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// receive calls the handler for every message until the connection fails or ctx is cancelled
+func (b *RedisBroker) receive(ctx context.Context, conn net.Conn, rd *bufio.Reader, handler func(data []byte)) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	for {
+		reply, err := readRESP(rd)
+		if err != nil {
+			return err
+		}
+		// Pushed messages are ["message", channel, data]
+		if parts, ok := reply.([]interface{}); ok && len(parts) == 3 {
+			if kind, _ := parts[0].([]byte); string(kind) == "message" {
+				if data, ok := parts[2].([]byte); ok {
+					handler(data)
+				}
+			}
+		}
+	}
+}
+
+// subscribe opens a connection subscribed to the channel
+func (b *RedisBroker) subscribe(ctx context.Context, channel string) (net.Conn, *bufio.Reader, error) {
+	conn, rd, err := b.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(b.dialTimeout()))
+	if _, err := conn.Write(encodeRESP("SUBSCRIBE", channel)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if _, err := readRESP(rd); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, rd, nil
+}
+
+// dial connects and authenticates
+func (b *RedisBroker) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	dialer := net.Dialer{Timeout: b.dialTimeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", b.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := bufio.NewReader(conn)
+
+	if b.Password != "" {
+		conn.SetDeadline(time.Now().Add(b.dialTimeout()))
+		if _, err := conn.Write(encodeRESP("AUTH", b.Password)); err == nil {
+			_, err = readRESP(rd)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("redis auth: %w", err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, rd, nil
+}
+
+func (b *RedisBroker) dialTimeout() time.Duration {
+	if b.DialTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return b.DialTimeout
+}
+
+// encodeRESP encodes a command as an array of bulk strings
+func encodeRESP(args ...string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// readRESP reads one reply. Simple strings and bulk strings are returned as []byte, integers as int64,
+// arrays as []interface{} and nulls as nil. Error replies are returned as a redisError.
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], string(line[1:len(line)-2])
+
+	switch kind {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply type %q", kind)
+	}
+}
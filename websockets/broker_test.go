@@ -0,0 +1,164 @@
+package websockets
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements PUBLISH and SUBSCRIBE of the Redis protocol
+type fakeRedis struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	r := &fakeRedis{listener: listener, subscribers: make(map[string][]net.Conn)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		args := reply.([]interface{})
+		switch cmd := string(args[0].([]byte)); cmd {
+		case "SUBSCRIBE":
+			channel := string(args[1].([]byte))
+			r.mu.Lock()
+			r.subscribers[channel] = append(r.subscribers[channel], conn)
+			r.mu.Unlock()
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n:1\r\n"))
+		case "PUBLISH":
+			channel, data := string(args[1].([]byte)), string(args[2].([]byte))
+			r.mu.Lock()
+			subscribers := r.subscribers[channel]
+			for _, sub := range subscribers {
+				sub.Write(encodeRESP("message", channel, data))
+			}
+			r.mu.Unlock()
+			conn.Write([]byte(":" + strconv.Itoa(len(subscribers)) + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command '" + cmd + "'\r\n"))
+		}
+	}
+}
+
+func TestBrokerFanOut(t *testing.T) {
+	redis := newFakeRedis(t)
+
+	a := New("0").EnableAll().Broker(NewRedisBroker(redis.listener.Addr().String()))
+	b := New("0").EnableAll().Broker(NewRedisBroker(redis.listener.Addr().String()))
+	defer a.brokerCancel()
+	defer b.brokerCancel()
+
+	subscriber := dialTestServer(t, a)
+	publisher := dialTestServer(t, b)
+	subscriber.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": "chat.*"}})
+	subscriber.ReadJSON(&Envelope{})
+	publisher.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": "chat.*"}})
+	publisher.ReadJSON(&Envelope{})
+
+	publisher.WriteJSON(Envelope{Type: "publish", Payload: []byte(`"hello"`), Metadata: map[string]string{"topic": "chat.lobby"}})
+	publisher.WriteJSON(Envelope{Type: "broadcast", Payload: []byte(`"everyone"`)})
+
+	for _, conn := range []interface {
+		ReadJSON(v interface{}) error
+		SetReadDeadline(t time.Time) error
+	}{subscriber, publisher} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil || env.Type != "publish" || string(env.Payload) != `"hello"` {
+			t.Fatalf("publish = %+v %s, %v", env, env.Payload, err)
+		}
+		// The publisher's own instance must not deliver the message a second time from the broker
+		if err := conn.ReadJSON(&env); err != nil || env.Type != "broadcast" || string(env.Payload) != `"everyone"` {
+			t.Fatalf("broadcast = %+v %s, %v", env, env.Payload, err)
+		}
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	a := New("0").EnableAll().Broker(broker)
+	b := New("0").EnableAll().Broker(broker)
+	defer a.brokerCancel()
+	defer b.brokerCancel()
+
+	conn := dialTestServer(t, a)
+	conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": "prices.>"}})
+	conn.ReadJSON(&Envelope{})
+
+	if delivered, err := b.Publish("prices.btc", 42); err != nil || delivered != 0 {
+		t.Fatalf("Publish = %d, %v", delivered, err)
+	}
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Metadata["topic"] != "prices.btc" || string(env.Payload) != "42" {
+		t.Fatalf("ReadJSON = %+v %s, %v", env, env.Payload, err)
+	}
+}
+
+func TestRedisBrokerPublishTimeout(t *testing.T) {
+	// A Redis that accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	broker := NewRedisBroker(listener.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The second publish waits for the first one, and gives up with it
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- broker.Publish(ctx, "websockets", []byte("{}")) }()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatalf("Publish to a stalled Redis succeeded")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Publish to a stalled Redis did not time out")
+		}
+	}
+}
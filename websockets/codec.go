@@ -0,0 +1,307 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+/*
+Codec encodes Envelopes onto the wire and decodes the Payload for handlers.
+
+The Codec for a connection is negotiated through the Sec-WebSocket-Protocol header
+using the value returned by Name. Connections that do not request a known subprotocol
+use JSON.
+
+	// Browser
+	new WebSocket("ws://localhost:8080", ["msgpack"])
+
+	// Server
+	wsServer := websockets.New("8080").Codecs(websockets.MsgPackCodec{}, websockets.ProtobufCodec{})
+*/
+type Codec interface {
+	// Name is the subprotocol the Codec is negotiated with
+	Name() string
+	// FrameType is the websocket message type frames are written with
+	FrameType() int
+
+	Encode(env *Envelope) ([]byte, error)
+	Decode(data []byte, env *Envelope) error
+
+	// Marshal and Unmarshal convert between Payloads and Go values
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var ErrEmptyPayload = errors.New("message has no payload")
+
+/*
+JSONCodec is the default Codec.
+
+Frames are sent as text and the Payload is embedded as raw JSON.
+*/
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string   { return "json" }
+func (JSONCodec) FrameType() int { return websocket.TextMessage }
+
+func (JSONCodec) Encode(env *Envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+func (JSONCodec) Decode(data []byte, env *Envelope) error {
+	return json.Unmarshal(data, env)
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return ErrEmptyPayload
+	}
+	return json.Unmarshal(data, v)
+}
+
+/*
+MsgPackCodec encodes frames as binary MessagePack maps.
+
+The Payload is embedded as raw MessagePack so clients decode the frame in a single pass
+
+	{"type": "echo", "id": "42", "payload": <msgpack value>, "metadata": {...}}
+*/
+type MsgPackCodec struct{}
+
+type msgpackEnvelope struct {
+	Type     string             `msgpack:"type"`
+	ID       string             `msgpack:"id,omitempty"`
+	Payload  msgpack.RawMessage `msgpack:"payload,omitempty"`
+	Metadata map[string]string  `msgpack:"metadata,omitempty"`
+}
+
+func (MsgPackCodec) Name() string   { return "msgpack" }
+func (MsgPackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (MsgPackCodec) Encode(env *Envelope) ([]byte, error) {
+	return msgpack.Marshal(&msgpackEnvelope{
+		Type:     env.Type,
+		ID:       env.ID,
+		Payload:  msgpack.RawMessage(env.Payload),
+		Metadata: env.Metadata,
+	})
+}
+
+func (MsgPackCodec) Decode(data []byte, env *Envelope) error {
+	var m msgpackEnvelope
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	env.Type = m.Type
+	env.ID = m.ID
+	env.Payload = json.RawMessage(m.Payload)
+	env.Metadata = m.Metadata
+	return nil
+}
+
+func (MsgPackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return ErrEmptyPayload
+	}
+	return msgpack.Unmarshal(data, v)
+}
+
+/*
+ProtobufCodec encodes frames as binary Protocol Buffers using the following schema
+
+	message Envelope {
+		string type = 1;
+		string id = 2;
+		bytes payload = 3;
+		map<string, string> metadata = 4;
+	}
+
+Payloads should be proto.Message values. Strings and []byte are passed through as raw bytes.
+
+Other values, such as the *Error of error frames, presence events and payloads transcoded from clients
+using another Codec, are encoded as a google.protobuf.Value holding their JSON form. Unmarshal decodes
+a google.protobuf.Value into targets that are not a proto.Message, so clients publish a google.protobuf.Value
+for their messages to reach clients using another Codec.
+*/
+type ProtobufCodec struct{}
+
+const (
+	envelopeTypeField     protowire.Number = 1
+	envelopeIDField       protowire.Number = 2
+	envelopePayloadField  protowire.Number = 3
+	envelopeMetadataField protowire.Number = 4
+)
+
+func (ProtobufCodec) Name() string   { return "protobuf" }
+func (ProtobufCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (ProtobufCodec) Encode(env *Envelope) ([]byte, error) {
+	var b []byte
+	if env.Type != "" {
+		b = protowire.AppendTag(b, envelopeTypeField, protowire.BytesType)
+		b = protowire.AppendString(b, env.Type)
+	}
+	if env.ID != "" {
+		b = protowire.AppendTag(b, envelopeIDField, protowire.BytesType)
+		b = protowire.AppendString(b, env.ID)
+	}
+	if len(env.Payload) > 0 {
+		b = protowire.AppendTag(b, envelopePayloadField, protowire.BytesType)
+		b = protowire.AppendBytes(b, env.Payload)
+	}
+	for key, value := range env.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, value)
+
+		b = protowire.AppendTag(b, envelopeMetadataField, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func (ProtobufCodec) Decode(data []byte, env *Envelope) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType || num < envelopeTypeField || num > envelopeMetadataField {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case envelopeTypeField:
+			env.Type = string(value)
+		case envelopeIDField:
+			env.ID = string(value)
+		case envelopePayloadField:
+			env.Payload = append(json.RawMessage(nil), value...)
+		case envelopeMetadataField:
+			key, val, err := decodeProtobufMapEntry(value)
+			if err != nil {
+				return err
+			}
+			if env.Metadata == nil {
+				env.Metadata = make(map[string]string)
+			}
+			env.Metadata[key] = val
+		}
+	}
+	return nil
+}
+
+func decodeProtobufMapEntry(data []byte) (string, string, error) {
+	var key, value string
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		field, n := protowire.ConsumeString(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case 1:
+			key = field
+		case 2:
+			value = field
+		}
+	}
+	return key, value, nil
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch payload := v.(type) {
+	case proto.Message:
+		return proto.Marshal(payload)
+	case []byte:
+		return payload, nil
+	case string:
+		return []byte(payload), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf codec cannot marshal %T: %w", v, err)
+		}
+		var value structpb.Value
+		if err := protojson.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("protobuf codec cannot marshal %T: %w", v, err)
+		}
+		return proto.Marshal(&value)
+	}
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch payload := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, payload)
+	case *[]byte:
+		*payload = append([]byte(nil), data...)
+		return nil
+	case *string:
+		if len(data) == 0 {
+			return ErrEmptyPayload
+		}
+		*payload = string(data)
+		return nil
+	default:
+		if len(data) == 0 {
+			return ErrEmptyPayload
+		}
+		var value structpb.Value
+		if err := proto.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("protobuf codec cannot unmarshal into %T: %w", v, err)
+		}
+		jsonData, err := protojson.Marshal(&value)
+		if err != nil {
+			return fmt.Errorf("protobuf codec cannot unmarshal into %T: %w", v, err)
+		}
+		return json.Unmarshal(jsonData, v)
+	}
+}
@@ -0,0 +1,165 @@
+package websockets
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, MsgPackCodec{}, ProtobufCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			var payload interface{} = map[string]interface{}{"text": "hello"}
+			if codec.Name() == "protobuf" {
+				payload = wrapperspb.String("hello")
+			}
+
+			data, err := codec.Marshal(payload)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+
+			frame, err := codec.Encode(&Envelope{
+				Type:     "chat",
+				ID:       "7",
+				Payload:  data,
+				Metadata: map[string]string{"trace": "abc"},
+			})
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			var env Envelope
+			if err := codec.Decode(frame, &env); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if env.Type != "chat" || env.ID != "7" || env.Metadata["trace"] != "abc" {
+				t.Fatalf("unexpected envelope: %+v", env)
+			}
+
+			if codec.Name() == "protobuf" {
+				var got wrapperspb.StringValue
+				if err := codec.Unmarshal(env.Payload, &got); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				if got.GetValue() != "hello" {
+					t.Fatalf("got payload %q", got.GetValue())
+				}
+				return
+			}
+
+			var got struct {
+				Text string `json:"text" msgpack:"text"`
+			}
+			if err := codec.Unmarshal(env.Payload, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got.Text != "hello" {
+				t.Fatalf("got payload %q", got.Text)
+			}
+		})
+	}
+}
+
+func TestProtobufCodecValues(t *testing.T) {
+	codec := ProtobufCodec{}
+	data, err := codec.Marshal(NewError(CodeNotFound, "no such room"))
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var value structpb.Value
+	if err := proto.Unmarshal(data, &value); err != nil {
+		t.Fatalf("payload is not a google.protobuf.Value: %v", err)
+	}
+	if fields := value.GetStructValue().GetFields(); fields["code"].GetStringValue() != string(CodeNotFound) {
+		t.Fatalf("got value %v", &value)
+	}
+
+	var wsErr Error
+	if err := codec.Unmarshal(data, &wsErr); err != nil || wsErr != *NewError(CodeNotFound, "no such room") {
+		t.Fatalf("Unmarshal = %+v, %v", wsErr, err)
+	}
+	var v interface{}
+	if err := codec.Unmarshal(data, &v); err != nil || v.(map[string]interface{})["message"] != "no such room" {
+		t.Fatalf("Unmarshal = %v, %v", v, err)
+	}
+}
+
+func TestProtobufErrorFrame(t *testing.T) {
+	ts := newTestServer(t, New("0").Codecs(ProtobufCodec{}))
+	conn, _, err := ts.connect(ts.url, nil, "protobuf")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	codec := ProtobufCodec{}
+	frame, _ := codec.Encode(&Envelope{Type: "missing", ID: "1"})
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	var env Envelope
+	if err := codec.Decode(data, &env); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	var wsErr Error
+	if err := codec.Unmarshal(env.Payload, &wsErr); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if env.Type != "error" || env.ID != "1" || wsErr.Code != CodeUnsupportedType {
+		t.Fatalf("got %+v %+v, want an unsupported_type error frame", env, wsErr)
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	s := New("0").EnableAll().Codecs(MsgPackCodec{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"msgpack"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != "msgpack" {
+		t.Fatalf("negotiated %q, want msgpack", conn.Subprotocol())
+	}
+
+	codec := MsgPackCodec{}
+	payload, _ := codec.Marshal("ping")
+	frame, _ := codec.Encode(&Envelope{Type: "echo", Payload: payload})
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Fatalf("got frame type %d, want binary", frameType)
+	}
+
+	var env Envelope
+	if err := codec.Decode(data, &env); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	var echoed string
+	if err := codec.Unmarshal(env.Payload, &echoed); err != nil || echoed != "ping" {
+		t.Fatalf("got echo %q (%v)", echoed, err)
+	}
+}
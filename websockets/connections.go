@@ -1,64 +1,208 @@
 package websockets
 
 import (
+	"context"
+	"crypto/x509"
 	"log"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
-	Conn *websocket.Conn
-	Mu   sync.Mutex
+	// ID is a random identifier assigned to the connection when it is accepted
+	ID    string
+	Conn  *websocket.Conn
+	Mu    sync.Mutex // held by the writer goroutine while writing to Conn
+	Codec Codec
+
+	// Principal is the identity returned by the server's Authenticator, nil when authentication is not enabled
+	Principal *Principal
+	// Certificate is the verified client certificate when mutual TLS is enabled
+	Certificate *x509.Certificate
+	// Request is the HTTP request the connection was upgraded from, nil for connections added with AddActiveConnection
+	Request *http.Request
+
+	server    *WsServer
+	queue     SendQueueConfig
+	heartbeat HeartbeatConfig
+	send      chan outbound
+	done      chan struct{}
+	closeOnce sync.Once
+
+	closeMu     sync.Mutex
+	closeCode   int
+	closeReason string
+
+	lastActivity int64 // unix nano of the last message read, accessed atomically
+	slow         int32 // set once the Client is disconnected as a slow consumer, accessed atomically
+
+	connectedAt      time.Time
+	messagesReceived int64 // accessed atomically
+	messagesSent     int64 // accessed atomically
+	clientErrors     int   // consecutive messages rejected with a client error, only used by the read loop
+
+	topics    map[string]struct{} // guarded by WsServer.topicsMu
+	replayMu  sync.Mutex          // guards pending
+	replaying int32               // number of history replays being written, accessed atomically
+	pending   []*Envelope         // messages delivered during a replay, queued once it is written
+
+	ip      string
+	limiter *clientLimiter
+	release func() // frees the Client's admission slot
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (s *WsServer) AddActiveConnection(conn *websocket.Conn) *WsServer {
-	s.activeClientsMu.Lock()
-	defer s.activeClientsMu.Unlock()
-	client := &Client{
-		Conn: conn,
-		Mu:   sync.Mutex{},
-	}
-	s.activeClients[client] = struct{}{} // Using struct{}{} as a placeholder value
+/*
+Context returns the Client's context, which is cancelled once the connection is removed or the server is shut down.
 
-	return s
+It carries the values of the HTTP request the connection was upgraded from, and the Client for ClientFromContext.
+*/
+func (c *Client) Context() context.Context {
+	return c.ctx
 }
 
-func (s *WsServer) RemoveConnection(conn *websocket.Conn) {
-	log.Printf("Removing Connection connection")
-	s.activeClientsMu.Lock()
-	defer s.activeClientsMu.Unlock()
+/*
+WriteEnvelope encodes the Envelope with the Client's Codec and queues it to be written to the connection.
+
+When the send queue is full the server's SlowConsumerPolicy is applied.
+*/
+func (c *Client) WriteEnvelope(env *Envelope) error {
+	data, err := c.Codec.Encode(env)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(outbound{frameType: c.Codec.FrameType(), data: data})
+}
 
-	var connsToRemove []*Client
+/*
+Send marshals the payload with the Client's Codec and queues it as a message of the given type.
 
-	for client := range s.activeClients {
-		if client.Conn == conn {
-			connsToRemove = append(connsToRemove, client)
+	err := client.Send("echo", "Hello")
+*/
+func (c *Client) Send(msgType string, payload interface{}) error {
+	env := &Envelope{Type: msgType}
+	if payload != nil {
+		data, err := c.Codec.Marshal(payload)
+		if err != nil {
+			return err
 		}
+		env.Payload = data
 	}
+	return c.WriteEnvelope(env)
+}
 
-	// Use a WaitGroup to wait for all pending writes to complete
-	var wg sync.WaitGroup
-	for _, client := range connsToRemove {
-		wg.Add(1)
-		go func(client *Client) {
-			client.Mu.Lock()
-			defer func() {
-				client.Mu.Unlock()
-				wg.Done()
-			}()
-
-			// Wait for any pending writes to complete before removing the connection
-			// For example, if there are multiple goroutines writing concurrently
-			// to this connection, they will wait here until the write is done.
-		}(client)
+/*
+Decode unmarshals a Payload received from the Client into v.
+*/
+func (c *Client) Decode(payload []byte, v interface{}) error {
+	return c.Codec.Unmarshal(payload, v)
+}
+
+/*
+AddActiveConnection registers an already upgraded connection. It is not checked against the Admission limits.
+*/
+func (s *WsServer) AddActiveConnection(conn *websocket.Conn, codec Codec) *Client {
+	return s.addClient(s.newClient(s.ctx, conn, codec))
+}
+
+// newClient creates the Client for an upgraded connection without registering it, its context is derived from parent
+func (s *WsServer) newClient(parent context.Context, conn *websocket.Conn, codec Codec) *Client {
+	client := &Client{
+		ID:          newID(),
+		connectedAt: time.Now(),
+		Conn:        conn,
+		Mu:          sync.Mutex{},
+		Codec:       codec,
+		server:      s,
+		queue:       s.sendQueue,
+		heartbeat:   s.heartbeat,
+		send:        make(chan outbound, s.sendQueue.Size),
+		done:        make(chan struct{}),
+		topics:      make(map[string]struct{}),
 	}
-	wg.Wait()
+	client.ctx, client.cancel = context.WithCancel(context.WithValue(parent, clientContextKey, client))
+	return client
+}
+
+// addClient registers the Client and starts its heartbeat and writer goroutine
+func (s *WsServer) addClient(client *Client) *Client {
+	if s.readLimit > 0 {
+		client.Conn.SetReadLimit(s.readLimit)
+	}
+	client.limiter = s.newLimiter(client)
+
+	s.activeClientsMu.Lock()
+	s.activeClients[client.Conn] = client
+	s.clientsByID[client.ID] = client
+	if client.Principal != nil {
+		users, ok := s.clientsByUser[client.Principal.UserID]
+		if !ok {
+			users = make(map[*Client]struct{})
+			s.clientsByUser[client.Principal.UserID] = users
+		}
+		users[client] = struct{}{}
+	}
+	s.activeClientsMu.Unlock()
+
+	client.startHeartbeat()
+	go client.writePump()
+	s.presenceJoin("", client)
+
+	return client
+}
+
+/*
+RemoveConnection removes the Client for the connection, stops its writer goroutine and closes the connection.
 
-	// Now that all pending writes are complete, it's safe to remove the connection
-	for _, client := range connsToRemove {
-		delete(s.activeClients, client)
+Queued messages that have not been written yet are discarded.
+*/
+func (s *WsServer) RemoveConnection(conn *websocket.Conn) {
+	log.Printf("Removing Connection connection")
+
+	s.activeClientsMu.Lock()
+	client, ok := s.activeClients[conn]
+	if !ok {
+		s.activeClientsMu.Unlock()
+		return
+	}
+	// The admission slot is freed before the Client is gone from the server, so once it is gone a new
+	// connection can take its place
+	if client.release != nil {
+		client.release()
 	}
+	delete(s.activeClients, conn)
+	delete(s.clientsByID, client.ID)
+	if client.Principal != nil {
+		users := s.clientsByUser[client.Principal.UserID]
+		if delete(users, client); len(users) == 0 {
+			delete(s.clientsByUser, client.Principal.UserID)
+		}
+	}
+	s.activeClientsMu.Unlock()
+
+	// The writer goroutine is not holding any server lock, so a client blocked on a slow write
+	// does not stall removal. Closing the connection unblocks the pending write.
+	s.unsubscribeAll(client)
+	s.presenceLeave("", client)
+	s.releaseLimiter(client)
+	client.cancel()
+	client.stop()
 
 	log.Printf("Removed Connection")
 }
+
+// clients returns a snapshot of the active Clients so they can be written to without holding the lock
+func (s *WsServer) clients() []*Client {
+	s.activeClientsMu.RLock()
+	defer s.activeClientsMu.RUnlock()
+	clients := make([]*Client, 0, len(s.activeClients))
+	for _, client := range s.activeClients {
+		clients = append(clients, client)
+	}
+	return clients
+}
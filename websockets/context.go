@@ -0,0 +1,86 @@
+package websockets
+
+import (
+	"context"
+	"time"
+)
+
+const traceIDMetadataKey = "trace_id"
+
+type contextKey int
+
+const (
+	clientContextKey contextKey = iota
+	traceIDContextKey
+)
+
+/*
+MessageTimeout sets a deadline on the ctx every message is handled with. Zero, the default, sets none.
+
+Unlike the Timeout middleware the handler is not abandoned, it is up to the handler and the calls it makes
+with ctx to stop at the deadline.
+
+	wsServer := server.New("8080").EnableAll().MessageTimeout(10 * time.Second)
+*/
+func (s *WsServer) MessageTimeout(timeout time.Duration) *WsServer {
+	s.messageTimeout = timeout
+	return s
+}
+
+/*
+ClientFromContext returns the Client a handler's ctx belongs to.
+*/
+func ClientFromContext(ctx context.Context) (*Client, bool) {
+	client, ok := ctx.Value(clientContextKey).(*Client)
+	return client, ok
+}
+
+/*
+PrincipalFromContext returns the authenticated identity of the Client a handler's ctx belongs to.
+*/
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	client, ok := ClientFromContext(ctx)
+	if !ok || client.Principal == nil {
+		return nil, false
+	}
+	return client.Principal, true
+}
+
+/*
+TraceID returns the trace id of the message being handled.
+
+It is the trace_id metadata of the message when the client sets one, a random id otherwise
+
+	{"type": "join", "id": "1", "metadata": {"trace_id": "4bf92f3577b34da6"}, "payload": {"room": "lobby"}}
+*/
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDContextKey).(string)
+	return traceID
+}
+
+// messageContext derives the ctx a message is handled with from the Client's context
+func (s *WsServer) messageContext(client *Client, msg *Envelope) (context.Context, context.CancelFunc) {
+	traceID := msg.Metadata[traceIDMetadataKey]
+	if traceID == "" {
+		traceID = newID()
+	}
+	ctx := context.WithValue(client.Context(), traceIDContextKey, traceID)
+	if s.messageTimeout > 0 {
+		return context.WithTimeout(ctx, s.messageTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// valuesContext is cancelled with its Context but also looks up values in another one, so a Client's context
+// carries the values of the upgrade request while being cancelled with the server
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
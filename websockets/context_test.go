@@ -0,0 +1,57 @@
+package websockets
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type tenantKey struct{}
+
+func TestMessageContext(t *testing.T) {
+	s := New("0").MessageTimeout(time.Minute).Authenticate(QueryParam("user", func(token string) (*Principal, error) {
+		return &Principal{UserID: token}, nil
+	}))
+	type observed struct {
+		user, trace, tenant string
+		deadline, gone      bool
+	}
+	seen := make(chan observed, 2)
+	s.HandleFunc("inspect", func(ctx context.Context, client *Client, msg *Envelope) error {
+		principal, _ := PrincipalFromContext(ctx)
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		_, deadline := ctx.Deadline()
+		seen <- observed{user: principal.UserID, trace: TraceID(ctx), tenant: tenant, deadline: deadline}
+		return nil
+	})
+	s.HandleFunc("wait", func(ctx context.Context, client *Client, msg *Envelope) error {
+		<-ctx.Done()
+		seen <- observed{gone: true}
+		return nil
+	})
+
+	// Values set by HTTP middleware reach the handlers
+	conn := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, "acme")))
+	})).dial("u1")
+
+	conn.WriteJSON(Envelope{Type: "inspect", Metadata: map[string]string{"trace_id": "abc"}})
+	if got := <-seen; got != (observed{user: "u1", trace: "abc", tenant: "acme", deadline: true}) {
+		t.Fatalf("handler observed %+v", got)
+	}
+	conn.WriteJSON(Envelope{Type: "inspect"})
+	if got := <-seen; got.trace == "" {
+		t.Fatalf("no trace id generated")
+	}
+
+	// Handlers observe the client going away
+	conn.WriteJSON(Envelope{Type: "wait"})
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+	select {
+	case <-seen:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ctx was not cancelled when the client disconnected")
+	}
+}
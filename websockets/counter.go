@@ -1,11 +1,116 @@
 package websockets
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type AtomicCounter struct {
 	totalConnections      int64
 	totalMessagesSent     int64
 	totalMessagesReceived int64
+	totalMessagesDropped  int64
+	totalSlowConsumers    int64
+	totalHeartbeatTimeout int64
+	totalIdleTimeouts     int64
+	totalAuthRejections   int64
+	totalOriginRejections int64
+	totalRateLimited      int64
+	totalOversized        int64
+	totalUpgradeFailures  int64
+	totalAdmissionRejects int64
+	totalClientErrors     int64
+	bytesReceived         int64
+	bytesSent             int64
+
+	messageTypesMu sync.Mutex
+	messageTypes   map[string]*MessageTypeStats
+}
+
+func (ac *AtomicCounter) IncrementRateLimited() {
+	atomic.AddInt64(&ac.totalRateLimited, 1)
+}
+
+func (ac *AtomicCounter) IncrementOversizedMessages() {
+	atomic.AddInt64(&ac.totalOversized, 1)
+}
+
+func (ac *AtomicCounter) IncrementUpgradeFailures() {
+	atomic.AddInt64(&ac.totalUpgradeFailures, 1)
+}
+
+func (ac *AtomicCounter) IncrementAdmissionRejections() {
+	atomic.AddInt64(&ac.totalAdmissionRejects, 1)
+}
+
+func (ac *AtomicCounter) IncrementClientErrors() {
+	atomic.AddInt64(&ac.totalClientErrors, 1)
+}
+
+func (ac *AtomicCounter) AddBytesReceived(n int) {
+	atomic.AddInt64(&ac.bytesReceived, int64(n))
+}
+
+func (ac *AtomicCounter) AddBytesSent(n int) {
+	atomic.AddInt64(&ac.bytesSent, int64(n))
+}
+
+// LatencyBuckets are the upper bounds of the handler latency histogram
+var LatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// MessageTypeStats are the handler metrics recorded for one message type by the Metrics middleware
+type MessageTypeStats struct {
+	Count        int64         `json:"count"`
+	Errors       int64         `json:"errors"`
+	TotalLatency time.Duration `json:"total_latency"`
+	MaxLatency   time.Duration `json:"max_latency"`
+	// Buckets counts the latencies up to each of LatencyBuckets, latencies above the last bound are only in Count
+	Buckets []int64 `json:"buckets"`
+}
+
+func (ac *AtomicCounter) ObserveMessage(msgType string, latency time.Duration, err error) {
+	ac.messageTypesMu.Lock()
+	defer ac.messageTypesMu.Unlock()
+	if ac.messageTypes == nil {
+		ac.messageTypes = make(map[string]*MessageTypeStats)
+	}
+	stats, ok := ac.messageTypes[msgType]
+	if !ok {
+		stats = &MessageTypeStats{Buckets: make([]int64, len(LatencyBuckets))}
+		ac.messageTypes[msgType] = stats
+	}
+	stats.Count++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			stats.Buckets[i]++
+			break
+		}
+	}
+}
+
+// MessageTypes returns a copy of the per message type metrics
+func (ac *AtomicCounter) MessageTypes() map[string]MessageTypeStats {
+	ac.messageTypesMu.Lock()
+	defer ac.messageTypesMu.Unlock()
+	stats := make(map[string]MessageTypeStats, len(ac.messageTypes))
+	for msgType, s := range ac.messageTypes {
+		copied := *s
+		copied.Buckets = append([]int64(nil), s.Buckets...)
+		stats[msgType] = copied
+	}
+	return stats
 }
 
 func (ac *AtomicCounter) IncrementTotalConnections() {
@@ -19,3 +124,27 @@ func (ac *AtomicCounter) IncrementTotalMessagesSent() {
 func (ac *AtomicCounter) IncrementTotalMessagesReceived() {
 	atomic.AddInt64(&ac.totalMessagesReceived, 1)
 }
+
+func (ac *AtomicCounter) IncrementTotalMessagesDropped() {
+	atomic.AddInt64(&ac.totalMessagesDropped, 1)
+}
+
+func (ac *AtomicCounter) IncrementSlowConsumers() {
+	atomic.AddInt64(&ac.totalSlowConsumers, 1)
+}
+
+func (ac *AtomicCounter) IncrementHeartbeatTimeouts() {
+	atomic.AddInt64(&ac.totalHeartbeatTimeout, 1)
+}
+
+func (ac *AtomicCounter) IncrementIdleTimeouts() {
+	atomic.AddInt64(&ac.totalIdleTimeouts, 1)
+}
+
+func (ac *AtomicCounter) IncrementAuthRejections() {
+	atomic.AddInt64(&ac.totalAuthRejections, 1)
+}
+
+func (ac *AtomicCounter) IncrementOriginRejections() {
+	atomic.AddInt64(&ac.totalOriginRejections, 1)
+}
@@ -0,0 +1,590 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+DialOptions configures a ClientConn. The zero value is usable.
+*/
+type DialOptions struct {
+	Header http.Header
+	// Codec is negotiated with the server through its subprotocol, defaulting to JSON
+	Codec  Codec
+	Dialer *websocket.Dialer
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between reconnection attempts, defaulting to 100ms and 30s
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// BufferSize is how many outgoing messages are kept while disconnected, defaulting to 256
+	BufferSize int
+	// ReadTimeout reconnects when nothing, including a ping, is received for this long. Defaults to 75s,
+	// which is longer than the server's default ping interval.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds every write, defaulting to 10s
+	WriteTimeout time.Duration
+
+	// OnConnect is called after every successful connection, including reconnections
+	OnConnect func(c *ClientConn)
+	// OnDisconnect is called with the error that ended a connection before reconnecting
+	OnDisconnect func(err error)
+}
+
+func (o *DialOptions) setDefaults() {
+	if o.Codec == nil {
+		o.Codec = JSONCodec{}
+	}
+	if o.Dialer == nil {
+		dialer := *websocket.DefaultDialer
+		o.Dialer = &dialer
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = 256
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = 75 * time.Second
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = 10 * time.Second
+	}
+}
+
+/*
+ClientConn is a Go client for WsServer that reconnects automatically.
+
+Messages sent while disconnected are buffered and written once the connection is back, and topic
+subscriptions are renewed on every reconnection.
+*/
+type ClientConn struct {
+	url  string
+	opts DialOptions
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	handlers map[string]func(env *Envelope)
+	pending  map[string]chan *Envelope
+	topics   map[string]*position
+
+	// epoch and broadcasts track the server's History so missed messages are replayed after reconnecting
+	epoch      string
+	broadcasts *position
+
+	send   chan []byte
+	retry  []byte // frame whose write failed, written first after reconnecting
+	nextID uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+	// inCallback is set while OnConnect or OnDisconnect runs on the run goroutine, which Close cannot wait for
+	inCallback int32
+}
+
+// position is the last sequence number received on a subscription
+type position struct {
+	seq   uint64
+	known bool
+}
+
+func (p *position) advance(seq uint64) {
+	if !p.known || seq > p.seq {
+		p.seq, p.known = seq, true
+	}
+}
+
+var (
+	ErrClientConnClosed = errors.New("client connection is closed")
+	// ErrCodecNotNegotiated is returned by Dial when the server does not support the DialOptions Codec
+	ErrCodecNotNegotiated = errors.New("codec was not negotiated")
+)
+
+/*
+Dial connects to a WsServer. The first connection attempt is not retried so configuration errors
+are reported immediately, later disconnections are retried until Close is called.
+
+	conn, err := websockets.Dial("ws://localhost:8080/ws", websockets.DialOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	websockets.On(conn, "publish", func(price Price) {
+		log.Printf("price %v", price)
+	})
+	conn.Subscribe("prices.>")
+
+	var members JoinResponse
+	err = conn.Request(ctx, "join", JoinRequest{Room: "lobby"}, &members)
+*/
+func Dial(url string, opts DialOptions) (*ClientConn, error) {
+	opts.setDefaults()
+	c := &ClientConn{
+		url:      url,
+		opts:     opts,
+		handlers: make(map[string]func(env *Envelope)),
+		pending:  make(map[string]chan *Envelope),
+		topics:   make(map[string]*position),
+		send:     make(chan []byte, opts.BufferSize),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(conn)
+	return c, nil
+}
+
+// dial connects and checks the server accepted the Codec, JSON is used when no subprotocol is negotiated
+func (c *ClientConn) dial() (*websocket.Conn, error) {
+	dialer := *c.opts.Dialer
+	name, want := c.opts.Codec.Name(), ""
+	if name != (JSONCodec{}).Name() {
+		dialer.Subprotocols = []string{name}
+		want = name
+	}
+	conn, _, err := dialer.Dial(c.url, c.opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	if got := conn.Subprotocol(); got != want && got != name {
+		conn.Close()
+		return nil, fmt.Errorf("%w: asked for %q, server chose %q", ErrCodecNotNegotiated, name, got)
+	}
+	return conn, nil
+}
+
+// run serves connections and reconnects until the ClientConn is closed
+func (c *ClientConn) run(conn *websocket.Conn) {
+	defer close(c.closed)
+	for {
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		if c.opts.OnConnect != nil {
+			c.callback(func() { c.opts.OnConnect(c) })
+		}
+
+		err := c.serve(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		if c.isClosed() {
+			return
+		}
+		if c.opts.OnDisconnect != nil {
+			c.callback(func() { c.opts.OnDisconnect(err) })
+		}
+
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+func (c *ClientConn) callback(fn func()) {
+	atomic.StoreInt32(&c.inCallback, 1)
+	defer atomic.StoreInt32(&c.inCallback, 0)
+	fn()
+}
+
+// reconnect dials with exponential backoff and jitter, returning nil once the ClientConn is closed
+func (c *ClientConn) reconnect() *websocket.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			return conn
+		}
+		log.Printf("Failed to reconnect to %s: %v", c.url, err)
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// serve writes buffered frames to the connection until it fails or the ClientConn is closed
+func (c *ClientConn) serve(conn *websocket.Conn) error {
+	defer conn.Close()
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- c.readLoop(conn) }()
+
+	write := func(frame []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+		if err := conn.WriteMessage(c.opts.Codec.FrameType(), frame); err != nil {
+			c.retry = frame
+			return err
+		}
+		return nil
+	}
+
+	// Subscriptions are renewed before anything buffered while disconnected is sent
+	for _, env := range c.resubscriptions() {
+		frame, err := c.encode(env)
+		if err == nil {
+			err = write(frame)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if c.retry != nil {
+		frame := c.retry
+		c.retry = nil
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-c.done:
+			deadline := time.Now().Add(time.Second)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+			return ErrClientConnClosed
+		case err := <-readErr:
+			return err
+		case frame := <-c.send:
+			if err := write(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readLoop dispatches incoming messages until the connection fails
+func (c *ClientConn) readLoop(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.opts.WriteTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+
+		env := &Envelope{}
+		if err := c.opts.Codec.Decode(data, env); err != nil {
+			log.Printf("Failed to decode message from %s: %v", c.url, err)
+			continue
+		}
+		c.dispatch(env)
+	}
+}
+
+// resubscriptions are the subscribe messages sent after reconnecting, resuming from the last message received
+func (c *ClientConn) resubscriptions() []*Envelope {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resume := func(metadata map[string]string, pos *position) map[string]string {
+		if pos.known && c.epoch != "" {
+			metadata[lastSeqMetadataKey] = strconv.FormatUint(pos.seq, 10)
+			metadata[epochMetadataKey] = c.epoch
+		}
+		return metadata
+	}
+
+	envs := make([]*Envelope, 0, len(c.topics)+1)
+	for pattern, pos := range c.topics {
+		envs = append(envs, &Envelope{Type: "subscribe", Metadata: resume(map[string]string{topicMetadataKey: pattern}, pos)})
+	}
+	if c.broadcasts != nil {
+		envs = append(envs, &Envelope{Type: "resume", Metadata: resume(map[string]string{}, c.broadcasts)})
+	}
+	return envs
+}
+
+// track records the sequence numbers of a server with History, c.mu must be held
+func (c *ClientConn) track(env *Envelope) {
+	seq, err := strconv.ParseUint(env.Metadata[seqMetadataKey], 10, 64)
+	if err != nil {
+		return
+	}
+	if epoch, ok := env.Metadata[epochMetadataKey]; ok {
+		c.epoch = epoch
+	}
+
+	topic := env.Metadata[topicMetadataKey]
+	switch env.Type {
+	case "publish":
+		for pattern, pos := range c.topics {
+			if topicMatches(pattern, topic) {
+				pos.advance(seq)
+			}
+		}
+	case "broadcast":
+		if c.broadcasts == nil {
+			c.broadcasts = &position{}
+		}
+		c.broadcasts.advance(seq)
+	case "subscribe", "reset":
+		// Acknowledgements and resets carry the position the subscription continues from
+		if pos, ok := c.topics[topic]; ok && (env.Type == "reset" || !pos.known) {
+			pos.seq, pos.known = seq, true
+		}
+		if env.Type == "reset" && topic == "" && c.broadcasts != nil {
+			c.broadcasts.seq = seq
+		}
+	}
+}
+
+// dispatch delivers replies to pending requests and everything else to the handler for the type
+func (c *ClientConn) dispatch(env *Envelope) {
+	c.mu.Lock()
+	c.track(env)
+	reply, isReply := c.pending[env.ID]
+	if isReply && env.ID != "" {
+		delete(c.pending, env.ID)
+	}
+	handler := c.handlers[env.Type]
+	c.mu.Unlock()
+
+	if isReply && env.ID != "" {
+		reply <- env
+		return
+	}
+	if handler != nil {
+		handler(env)
+	}
+}
+
+/*
+HandleFunc sets the handler for messages of the given type. Handlers run on the read goroutine,
+so they should hand long running work off to another goroutine.
+*/
+func (c *ClientConn) HandleFunc(msgType string, handler func(env *Envelope)) *ClientConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[msgType] = handler
+	return c
+}
+
+/*
+On sets a typed handler for messages of the given type, the Payload is decoded into T with the connection's Codec.
+*/
+func On[T any](c *ClientConn, msgType string, fn func(msg T)) {
+	c.HandleFunc(msgType, func(env *Envelope) {
+		var msg T
+		if len(env.Payload) > 0 {
+			if err := c.opts.Codec.Unmarshal(env.Payload, &msg); err != nil {
+				log.Printf("Failed to decode %q message: %v", msgType, err)
+				return
+			}
+		}
+		fn(msg)
+	})
+}
+
+func (c *ClientConn) encode(env *Envelope) ([]byte, error) {
+	return c.opts.Codec.Encode(env)
+}
+
+// enqueue buffers the frame, failing when the buffer is full
+func (c *ClientConn) enqueue(env *Envelope) error {
+	if c.isClosed() {
+		return ErrClientConnClosed
+	}
+	frame, err := c.encode(env)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.send <- frame:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+func (c *ClientConn) envelope(msgType string, payload interface{}) (*Envelope, error) {
+	env := &Envelope{Type: msgType}
+	if payload != nil {
+		data, err := c.opts.Codec.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return env, nil
+}
+
+/*
+Send queues a message of the given type. It is buffered while the connection is down.
+
+Delivery is at most once, a message written just before the connection drops can be lost.
+*/
+func (c *ClientConn) Send(msgType string, payload interface{}) error {
+	env, err := c.envelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(env)
+}
+
+/*
+Request sends a message and waits for the reply with the same id, decoding its Payload into result.
+
+An error frame from the server is returned as an *Error. The wait is bounded by ctx and survives reconnections.
+*/
+func (c *ClientConn) Request(ctx context.Context, msgType string, payload interface{}, result interface{}) error {
+	env, err := c.envelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	env.ID = strconv.FormatUint(atomic.AddUint64(&c.nextID, 1), 10)
+
+	reply := make(chan *Envelope, 1)
+	c.mu.Lock()
+	c.pending[env.ID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, env.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.enqueue(env); err != nil {
+		return err
+	}
+
+	select {
+	case res := <-reply:
+		if res.Type == "error" {
+			wsErr := &Error{}
+			if err := c.opts.Codec.Unmarshal(res.Payload, wsErr); err != nil {
+				return err
+			}
+			return wsErr
+		}
+		if result == nil || len(res.Payload) == 0 {
+			return nil
+		}
+		return c.opts.Codec.Unmarshal(res.Payload, result)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClientConnClosed
+	}
+}
+
+/*
+Subscribe subscribes to the topic pattern, and again after every reconnection.
+
+When the server keeps a History the messages missed while disconnected are replayed. If they are no longer
+retained a "reset" message is received instead, set a handler for it with HandleFunc to reload state.
+*/
+func (c *ClientConn) Subscribe(pattern string) error {
+	if err := validateTopic(pattern, true); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if _, exists := c.topics[pattern]; !exists {
+		c.topics[pattern] = &position{}
+	}
+	connected := c.conn != nil
+	c.mu.Unlock()
+
+	// While disconnected the subscription is sent when the connection is back
+	if !connected {
+		return nil
+	}
+	return c.enqueue(&Envelope{Type: "subscribe", Metadata: map[string]string{topicMetadataKey: pattern}})
+}
+
+/*
+Unsubscribe removes the subscription to the topic pattern.
+*/
+func (c *ClientConn) Unsubscribe(pattern string) error {
+	c.mu.Lock()
+	delete(c.topics, pattern)
+	c.mu.Unlock()
+	return c.enqueue(&Envelope{Type: "unsubscribe", Metadata: map[string]string{topicMetadataKey: pattern}})
+}
+
+/*
+Publish sends the payload to the subscribers of the topic.
+*/
+func (c *ClientConn) Publish(topic string, payload interface{}) error {
+	env, err := c.envelope("publish", payload)
+	if err != nil {
+		return err
+	}
+	env.Metadata = map[string]string{topicMetadataKey: topic}
+	return c.enqueue(env)
+}
+
+/*
+Subscriptions returns the topic patterns that are renewed on reconnection.
+*/
+func (c *ClientConn) Subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	patterns := make([]string, 0, len(c.topics))
+	for pattern := range c.topics {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+/*
+Close sends a close frame and stops reconnecting. Buffered messages that were not written are discarded.
+
+Close waits for the connection to be closed, except when called from OnConnect or OnDisconnect where it
+returns immediately and the connection is closed once the callback returns.
+*/
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	if atomic.LoadInt32(&c.inCallback) == 0 {
+		<-c.closed
+	}
+	return nil
+}
+
+func (c *ClientConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDialReconnects(t *testing.T) {
+	s := New("0").EnableAll()
+	Handle(s, "join", func(ctx context.Context, client *Client, req joinRequest) (joinResponse, error) {
+		return joinResponse{Room: req.Room, Members: 2}, nil
+	})
+	ts := newTestServer(t, s)
+
+	connected, disconnected := make(chan struct{}, 4), make(chan struct{}, 4)
+	conn, err := Dial(ts.url, DialOptions{
+		MinBackoff:   10 * time.Millisecond,
+		OnConnect:    func(*ClientConn) { connected <- struct{}{} },
+		OnDisconnect: func(error) { disconnected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	<-connected
+
+	prices := make(chan int, 4)
+	On(conn, "publish", func(price int) { prices <- price })
+	echoes := make(chan string, 4)
+	On(conn, "echo", func(msg string) { echoes <- msg })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var res joinResponse
+	if err := conn.Request(ctx, "join", joinRequest{Room: "lobby"}, &res); err != nil || res.Members != 2 {
+		t.Fatalf("Request = %+v, %v", res, err)
+	}
+	var wsErr *Error
+	if err := conn.Request(ctx, "join", joinRequest{}, nil); !errors.As(err, &wsErr) || wsErr.Code != CodeValidationFailed {
+		t.Fatalf("Request error = %v", err)
+	}
+
+	if err := conn.Subscribe("prices.>"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	// The subscription is acknowledged before anything is published
+	if err := conn.Request(ctx, "join", joinRequest{Room: "sync"}, nil); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+
+	// Drop the connection server side, the client reconnects and subscribes again
+	s.TerminateConnections()
+	<-disconnected
+	conn.Send("echo", "buffered")
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatalf("client did not reconnect")
+	}
+
+	select {
+	case msg := <-echoes:
+		if msg != "buffered" {
+			t.Fatalf("echo = %q", msg)
+		}
+	case <-ctx.Done():
+		t.Fatalf("buffered message was not sent after reconnecting")
+	}
+
+	if delivered, _ := s.Publish("prices.btc", 42); delivered != 1 {
+		t.Fatalf("Publish delivered to %d clients", delivered)
+	}
+	select {
+	case price := <-prices:
+		if price != 42 {
+			t.Fatalf("price = %d", price)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no publish after reconnecting")
+	}
+}
+
+func TestDialCodecNotNegotiated(t *testing.T) {
+	ts := newTestServer(t, New("0").EnableAll())
+	if _, err := Dial(ts.url, DialOptions{Codec: MsgPackCodec{}}); !errors.Is(err, ErrCodecNotNegotiated) {
+		t.Fatalf("Dial with a codec the server does not support = %v, want ErrCodecNotNegotiated", err)
+	}
+
+	ts = newTestServer(t, New("0").EnableAll().Codecs(MsgPackCodec{}))
+	conn, err := Dial(ts.url, DialOptions{Codec: MsgPackCodec{}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestDialCloseFromOnConnect(t *testing.T) {
+	ts := newTestServer(t, New("0").EnableAll())
+	closed := make(chan struct{})
+	conn, err := Dial(ts.url, DialOptions{
+		OnConnect: func(c *ClientConn) {
+			c.Close()
+			close(closed)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close from OnConnect did not return")
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("connection was not closed after OnConnect returned")
+	}
+	if err := conn.Send("echo", "after close"); !errors.Is(err, ErrClientConnClosed) {
+		t.Fatalf("Send after Close = %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+)
+
+const (
+	toMetadataKey       = "to"
+	toUserMetadataKey   = "to_user"
+	fromMetadataKey     = "from"
+	fromUserMetadataKey = "from_user"
+)
+
+// ErrClientNotFound is returned when no connected Client matches the ID or user
+var ErrClientNotFound = errors.New("client not found")
+
+/*
+DirectPermission decides whether the sender may send a direct message to the recipient.
+*/
+type DirectPermission func(from, to *Client) bool
+
+/*
+Client returns the connected Client with the ID.
+*/
+func (s *WsServer) Client(clientID string) (*Client, bool) {
+	s.activeClientsMu.RLock()
+	defer s.activeClientsMu.RUnlock()
+	client, ok := s.clientsByID[clientID]
+	return client, ok
+}
+
+/*
+UserClients returns the connected Clients authenticated as the user.
+*/
+func (s *WsServer) UserClients(userID string) []*Client {
+	s.activeClientsMu.RLock()
+	defer s.activeClientsMu.RUnlock()
+	clients := make([]*Client, 0, len(s.clientsByUser[userID]))
+	for client := range s.clientsByUser[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+/*
+SendTo sends a message of the given type to the Client with the ID.
+
+	err := wsServer.SendTo(clientID, "notification", Notification{Text: "Build finished"})
+
+Only Clients connected to this instance are reachable, ErrClientNotFound is returned otherwise.
+*/
+func (s *WsServer) SendTo(clientID, msgType string, payload interface{}) error {
+	client, ok := s.Client(clientID)
+	if !ok {
+		return ErrClientNotFound
+	}
+	return client.Send(msgType, payload)
+}
+
+/*
+SendToUser sends a message of the given type to every connection of the user, returning the number of
+connections it was queued for.
+
+	delivered, err := wsServer.SendToUser("u1", "notification", Notification{Text: "Build finished"})
+
+ErrClientNotFound is returned when the user has no connection to this instance.
+*/
+func (s *WsServer) SendToUser(userID, msgType string, payload interface{}) (int, error) {
+	clients := s.UserClients(userID)
+	if len(clients) == 0 {
+		return 0, ErrClientNotFound
+	}
+	delivered := 0
+	for _, client := range clients {
+		if err := client.Send(msgType, payload); err != nil {
+			log.Printf("Failed to send %s to a client of %s: %v", msgType, userID, err)
+			continue
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+/*
+EnableDirect enables the direct message type, for clients to message a connection or every connection of a user
+
+	{"type": "direct", "id": "1", "metadata": {"to": "9f2c4e1a7b3d5f60"}, "payload": "Hi"}
+	{"type": "direct", "id": "2", "metadata": {"to_user": "u2"}, "payload": "Hi"}
+
+Recipients receive the message with the sender's Client ID, and user when it is authenticated
+
+	{"type": "direct", "metadata": {"from": "4b0e8d2c6a1f3e57", "from_user": "u1"}, "payload": "Hi"}
+
+Messages with an ID are acknowledged with the number of connections they were delivered to
+
+	{"type": "direct", "id": "1", "metadata": {"delivered": "1"}}
+
+The permission is checked for every recipient. Messages to a recipient that is not connected are answered with
+a not found error, and so are messages no recipient accepts when a DirectPermission is set, so clients cannot
+tell whether users they may not message are online. A nil DirectPermission allows clients to message anyone.
+
+	wsServer := server.New("8080").EnableAll().EnableDirect(func(from, to *websockets.Client) bool {
+		return from.Principal != nil && to.Principal != nil && from.Principal.Claims["team"] == to.Principal.Claims["team"]
+	})
+*/
+func (s *WsServer) EnableDirect(permit DirectPermission) *WsServer {
+	s.directPermission = permit
+	s.HandleFunc("direct", s.DirectHandler)
+	return s
+}
+
+/*
+DirectHandler delivers a direct message, see EnableDirect.
+*/
+func (s *WsServer) DirectHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	var recipients []*Client
+	switch to, toUser := msg.Metadata[toMetadataKey], msg.Metadata[toUserMetadataKey]; {
+	case to != "":
+		if recipient, ok := s.Client(to); ok {
+			recipients = append(recipients, recipient)
+		}
+	case toUser != "":
+		recipients = s.UserClients(toUser)
+	default:
+		return s.replyError(client, msg, NewError(CodeBadRequest, "direct messages need a to or to_user metadata"))
+	}
+	notFound := NewError(CodeNotFound, ErrClientNotFound.Error())
+	if len(recipients) == 0 {
+		return s.replyError(client, msg, notFound)
+	}
+
+	metadata := map[string]string{fromMetadataKey: client.ID}
+	if client.Principal != nil {
+		metadata[fromUserMetadataKey] = client.Principal.UserID
+	}
+	delivered, permitted := 0, 0
+	for _, recipient := range recipients {
+		if s.directPermission != nil && !s.directPermission(client, recipient) {
+			continue
+		}
+		permitted++
+		payload, err := transcode(msg.Payload, client.Codec, recipient.Codec)
+		if err != nil {
+			return s.replyError(client, msg, NewError(CodeInvalidPayload, err.Error()))
+		}
+		if err := recipient.WriteEnvelope(&Envelope{Type: msg.Type, Payload: payload, Metadata: metadata}); err != nil {
+			log.Printf("Failed to send direct message to a client: %v", err)
+			continue
+		}
+		delivered++
+	}
+	if permitted == 0 {
+		return s.replyError(client, msg, notFound)
+	}
+
+	if msg.ID == "" {
+		return nil
+	}
+	return client.WriteEnvelope(&Envelope{
+		Type:     msg.Type,
+		ID:       msg.ID,
+		Metadata: map[string]string{"delivered": strconv.Itoa(delivered)},
+	})
+}
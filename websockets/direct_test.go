@@ -0,0 +1,68 @@
+package websockets
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDirect(t *testing.T) {
+	s := New("0").EnableDirect(func(from, to *Client) bool {
+		return to.Principal.UserID != "private"
+	}).Authenticate(userAuthenticator())
+	dial := newTestServer(t, s).dial
+	read := func(conn *websocket.Conn) Envelope {
+		t.Helper()
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		return env
+	}
+
+	alice, bob1, bob2 := dial("alice"), dial("bob"), dial("bob")
+	dial("private")
+	for len(s.clients()) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	aliceID := s.UserClients("alice")[0].ID
+
+	alice.WriteJSON(Envelope{Type: "direct", ID: "1", Metadata: map[string]string{"to_user": "bob"}, Payload: []byte(`"hi"`)})
+	for _, bob := range []*websocket.Conn{bob1, bob2} {
+		if env := read(bob); env.Metadata["from"] != aliceID || env.Metadata["from_user"] != "alice" || string(env.Payload) != `"hi"` {
+			t.Fatalf("bob received %+v", env)
+		}
+	}
+	if ack := read(alice); ack.ID != "1" || ack.Metadata["delivered"] != "2" {
+		t.Fatalf("ack = %+v", ack)
+	}
+
+	// Replies go to the connection that sent the message
+	bob1.WriteJSON(Envelope{Type: "direct", Metadata: map[string]string{"to": aliceID}, Payload: []byte(`"hey"`)})
+	if env := read(alice); string(env.Payload) != `"hey"` || env.Metadata["from_user"] != "bob" {
+		t.Fatalf("alice received %+v", env)
+	}
+
+	// Users alice may not message look the same as users who are offline
+	var replies []string
+	for _, user := range []string{"private", "nobody"} {
+		alice.WriteJSON(Envelope{Type: "direct", ID: "2", Metadata: map[string]string{"to_user": user}})
+		env := read(alice)
+		if env.Type != "error" || !strings.Contains(string(env.Payload), string(CodeNotFound)) {
+			t.Fatalf("direct to %s = %+v, want %s", user, env, CodeNotFound)
+		}
+		replies = append(replies, string(env.Payload))
+	}
+	if replies[0] != replies[1] {
+		t.Fatalf("forbidden error %s differs from offline error %s", replies[0], replies[1])
+	}
+
+	if delivered, err := s.SendToUser("bob", "notice", "deploy"); err != nil || delivered != 2 {
+		t.Fatalf("SendToUser = %d, %v", delivered, err)
+	}
+	if err := s.SendTo("missing", "notice", nil); err != ErrClientNotFound {
+		t.Fatalf("SendTo missing = %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package websockets
+
+import "encoding/json"
+
+/*
+Envelope is the typed frame exchanged between the Web Socket Server and its clients.
+
+The Payload is kept as raw bytes in the encoding of the connection's Codec so that
+handlers can decode it into their own structs.
+
+	{
+		"type": "echo",
+		"id": "42",
+		"payload": "Hello",
+		"metadata": {"trace": "abc"}
+	}
+
+Handlers decode the payload with the Codec negotiated for the connection
+
+	var req ChatMessage
+	if err := client.Decode(msg.Payload, &req); err != nil {
+		return err
+	}
+*/
+type Envelope struct {
+	Type     string            `json:"type"`
+	ID       string            `json:"id,omitempty"`
+	Payload  json.RawMessage   `json:"payload,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
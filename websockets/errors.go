@@ -0,0 +1,158 @@
+package websockets
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorCode identifies the kind of failure reported in an error frame
+type ErrorCode string
+
+const (
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeInvalidMessage   ErrorCode = "invalid_message"
+	CodeUnsupportedType  ErrorCode = "unsupported_type"
+	CodeInvalidPayload   ErrorCode = "invalid_payload"
+	CodeValidationFailed ErrorCode = "validation_failed"
+	CodeInvalidTopic     ErrorCode = "invalid_topic"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeConflict         ErrorCode = "conflict"
+	CodeTimeout          ErrorCode = "timeout"
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeUnavailable      ErrorCode = "unavailable"
+	CodeInternal         ErrorCode = "internal_error"
+)
+
+/*
+Error is sent to the client as the payload of an error frame, with the ID of the message it is about
+
+	{"type": "error", "id": "42", "payload": {"code": "validation_failed", "message": "room is required"}}
+
+Error frames are sent automatically for
+
+  - messages that cannot be decoded, with CodeInvalidMessage and no ID
+  - message types without a handler, with CodeUnsupportedType
+  - errors returned by handlers, other errors than an *Error are sent as CodeInternal without their message
+  - rate limit violations with the ReplyRateLimited policy, with CodeRateLimited
+
+Handlers can return an *Error to control the code the client receives.
+
+	return JoinResponse{}, websockets.NewError("room_full", "room is full")
+*/
+type Error struct {
+	Code    ErrorCode `json:"code" msgpack:"code"`
+	Message string    `json:"message" msgpack:"message"`
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// errInternal is sent in place of errors that are not an *Error, their message may hold server internals
+var errInternal = NewError(CodeInternal, "internal error")
+
+/*
+SendError writes an error frame to the Client in reply to msg.
+
+Errors that are not an *Error are reported with CodeInternal without their message.
+*/
+func (c *Client) SendError(msg *Envelope, err error) error {
+	var wsErr *Error
+	if !errors.As(err, &wsErr) {
+		wsErr = errInternal
+	}
+
+	payload, marshalErr := c.Codec.Marshal(wsErr)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	env := &Envelope{Type: "error", Payload: payload}
+	if msg != nil {
+		env.ID = msg.ID
+	}
+	return c.WriteEnvelope(env)
+}
+
+// replied wraps an error that was already sent to the client, so it is not sent a second time
+type replied struct {
+	error
+	// delivered is false when the error frame could not be sent
+	delivered bool
+}
+
+func (r replied) Unwrap() error {
+	return r.error
+}
+
+/*
+MaxClientErrors disconnects clients with websocket.ClosePolicyViolation after max consecutive messages rejected
+with a client error, such as messages that cannot be decoded, unsupported types, invalid payloads and rate limit
+violations. Server side errors such as CodeInternal and CodeTimeout are not counted, nor are error frames that
+could not be sent. JSON-RPC error responses are counted the same way. Zero, the default, never disconnects.
+
+	wsServer := server.New("8080").EnableAll().MaxClientErrors(10)
+*/
+func (s *WsServer) MaxClientErrors(max int) *WsServer {
+	s.maxClientErrors = max
+	return s
+}
+
+// clientFault reports whether an error frame with the code is caused by the client
+func (code ErrorCode) clientFault() bool {
+	switch code {
+	case CodeInternal, CodeUnavailable, CodeTimeout:
+		return false
+	}
+	return true
+}
+
+// rejectMessage sends the error frame for a message that was not handled. wsErr can be nil for messages
+// dropped without a reply. Errors that could not be sent are not counted, clients are only disconnected for
+// errors they were told about.
+func (s *WsServer) rejectMessage(client *Client, msg *Envelope, wsErr *Error) {
+	if wsErr != nil && !s.sendError(client, msg, wsErr) {
+		return
+	}
+	s.clientError(client)
+}
+
+// handlerFailed sends the error returned by a handler to the client, unless the handler already replied with it
+func (s *WsServer) handlerFailed(client *Client, msg *Envelope, err error) {
+	var wsErr *Error
+	if !errors.As(err, &wsErr) {
+		wsErr = errInternal
+	}
+	var sent replied
+	var delivered bool
+	if errors.As(err, &sent) {
+		delivered = sent.delivered
+	} else {
+		delivered = s.sendError(client, msg, wsErr)
+	}
+	switch {
+	case !wsErr.Code.clientFault():
+		client.clientErrors = 0
+	case delivered:
+		s.clientError(client)
+	}
+}
+
+// clientError counts a message the client got wrong, disconnecting it past MaxClientErrors
+func (s *WsServer) clientError(client *Client) {
+	s.counter.IncrementClientErrors()
+	client.clientErrors++
+	if s.maxClientErrors > 0 && client.clientErrors >= s.maxClientErrors {
+		log.Printf("Client %s sent %d invalid messages in a row, closing the Connection", client.ID, client.clientErrors)
+		client.disconnectAfterQueued(websocket.ClosePolicyViolation, "too many invalid messages")
+	}
+}
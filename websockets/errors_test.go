@@ -0,0 +1,131 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestErrorFrames(t *testing.T) {
+	s := New("0").EnableAll().MaxClientErrors(3)
+	s.HandleFunc("fail", func(ctx context.Context, client *Client, msg *Envelope) error {
+		return errors.New("database password is hunter2")
+	})
+	conn := dialTestServer(t, s)
+
+	expectError := func(id string, code ErrorCode) {
+		t.Helper()
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		var wsErr Error
+		if err := (JSONCodec{}).Unmarshal(env.Payload, &wsErr); err != nil || env.Type != "error" || env.ID != id || wsErr.Code != code {
+			t.Fatalf("got %s %q %s, want error %q %s", env.Type, env.ID, env.Payload, id, code)
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	expectError("", CodeInvalidMessage)
+	conn.WriteJSON(Envelope{Type: "nope", ID: "1"})
+	expectError("1", CodeUnsupportedType)
+
+	// A successful message resets the count of consecutive client errors
+	conn.WriteJSON(Envelope{Type: "healthcheck"})
+	var env Envelope
+	conn.ReadJSON(&env)
+
+	// Server errors are sent without their message and do not count
+	conn.WriteJSON(Envelope{Type: "fail", ID: "2"})
+	expectError("2", CodeInternal)
+
+	// Handlers that reply with an error themselves are not answered twice
+	conn.WriteJSON(Envelope{Type: "subscribe", ID: "3", Metadata: map[string]string{"topic": "bad..topic"}})
+	expectError("3", CodeInvalidTopic)
+	conn.WriteJSON(Envelope{Type: "nope", ID: "4"})
+	expectError("4", CodeUnsupportedType)
+	conn.WriteJSON(Envelope{Type: "nope", ID: "5"})
+	expectError("5", CodeUnsupportedType)
+
+	var closeErr *websocket.CloseError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("ReadMessage error = %v, want policy violation", err)
+	}
+	if stats := s.Stats(); stats.ClientErrors != 5 {
+		t.Fatalf("ClientErrors = %d, want 5", stats.ClientErrors)
+	}
+}
+
+func TestRequestErrorsHideMessage(t *testing.T) {
+	secret := func(ctx context.Context, client *Client, req joinRequest) (joinResponse, error) {
+		return joinResponse{}, errors.New("secret")
+	}
+
+	s := New("0")
+	Handle(s, "join", secret)
+	conn := dialTestServer(t, s)
+	conn.WriteJSON(Envelope{Type: "join", ID: "1", Payload: []byte(`{"room":"lobby"}`)})
+	_, data, err := conn.ReadMessage()
+	if err != nil || !strings.Contains(string(data), string(CodeInternal)) || strings.Contains(string(data), "secret") {
+		t.Fatalf("error frame = %s, %v, want internal error without the message", data, err)
+	}
+
+	rpc := New("0").JSONRPC()
+	Handle(rpc, "join", secret)
+	conn = dialTestServer(t, rpc)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"join","params":{"room":"lobby"},"id":1}`))
+	if _, data, err = conn.ReadMessage(); err != nil || strings.Contains(string(data), "secret") {
+		t.Fatalf("JSON-RPC error = %s, %v, want internal error without the message", data, err)
+	}
+}
+
+func TestMaxClientErrorsJSONRPC(t *testing.T) {
+	conn := dialTestServer(t, New("0").JSONRPC().MaxClientErrors(2))
+
+	for _, req := range []string{
+		`{"jsonrpc":"2.0","method":"missing","id":1}`,
+		`{"jsonrpc":"2.0","method":"missing","id":2}`,
+	} {
+		conn.WriteMessage(websocket.TextMessage, []byte(req))
+		if _, data, err := conn.ReadMessage(); err != nil || !strings.Contains(string(data), "method not found") {
+			t.Fatalf("response = %s, %v, want method not found", data, err)
+		}
+	}
+
+	var closeErr *websocket.CloseError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("ReadMessage error = %v, want policy violation", err)
+	}
+}
+
+// errorlessCodec cannot marshal error frames
+type errorlessCodec struct {
+	JSONCodec
+}
+
+func (errorlessCodec) Name() string { return "errorless" }
+
+func (errorlessCodec) Marshal(v interface{}) ([]byte, error) {
+	if _, ok := v.(*Error); ok {
+		return nil, errors.New("cannot marshal errors")
+	}
+	return JSONCodec{}.Marshal(v)
+}
+
+func TestUndeliveredErrorsNotCounted(t *testing.T) {
+	ts := newTestServer(t, New("0").EnableAll().Codecs(errorlessCodec{}).MaxClientErrors(1))
+	conn, _, err := ts.connect(ts.url, nil, "errorless")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	conn.WriteJSON(Envelope{Type: "nope", ID: "1"})
+	conn.WriteJSON(Envelope{Type: "healthcheck"})
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "healthcheck" {
+		t.Fatalf("ReadJSON = %+v, %v, want the healthcheck reply", env, err)
+	}
+}
@@ -0,0 +1,149 @@
+package websockets
+
+import (
+	"context"
+	"log"
+)
+
+/*
+HandleFunc registers the Handler for messages of the given type.
+
+Handlers can be registered and replaced while the server is running. The middleware only wraps
+this handler, inside the middleware added with Use.
+
+	wsServer.HandleFunc("chat", func(ctx context.Context, client *websockets.Client, msg *websockets.Envelope) error {
+		var chat ChatMessage
+		if err := client.Decode(msg.Payload, &chat); err != nil {
+			return err
+		}
+		...
+	}, websockets.Timeout(time.Second))
+*/
+func (s *WsServer) HandleFunc(msgType string, handler Handler, middleware ...Middleware) *WsServer {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.handlers[msgType] = &handlerEntry{handler: handler, middleware: middleware}
+	return s
+}
+
+// handlerEntry is a registered Handler with its own middleware
+type handlerEntry struct {
+	handler    Handler
+	middleware []Middleware
+	// request is set for handlers registered with HandleRequest, so protocols that need the result can run it directly
+	request *requestRoute
+}
+
+/*
+RemoveHandler unregisters the Handler for messages of the given type.
+*/
+func (s *WsServer) RemoveHandler(msgType string) *WsServer {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	delete(s.handlers, msgType)
+	return s
+}
+
+// handler returns the Handler registered for the message type wrapped in its middleware
+func (s *WsServer) handler(msgType string) (Handler, bool) {
+	entry, middleware, exists := s.route(msgType)
+	if !exists {
+		return nil, false
+	}
+	return chain(entry.handler, middleware), true
+}
+
+// route returns the entry registered for the message type and the middleware that wraps it, outermost first
+func (s *WsServer) route(msgType string) (*handlerEntry, []Middleware, bool) {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+	entry, exists := s.handlers[msgType]
+	if !exists {
+		return nil, nil, false
+	}
+	middleware := make([]Middleware, 0, len(s.middleware)+len(entry.middleware))
+	middleware = append(middleware, s.middleware...)
+	middleware = append(middleware, entry.middleware...)
+	return entry, middleware, true
+}
+
+/*
+NoReply is used as the response type of typed handlers that do not reply to the client.
+*/
+type NoReply struct{}
+
+/*
+Validator is implemented by request types that should be checked after they are decoded.
+
+Validation errors are sent back to the client as an error frame.
+*/
+type Validator interface {
+	Validate() error
+}
+
+/*
+Handle registers a typed handler for messages of the given type.
+
+The Payload is decoded into T with the connection's Codec and validated if T implements Validator.
+Decode and validation failures, and errors returned by fn, are sent back to the client as an error frame.
+The response is sent to the client with the same type and the ID of the request unless R is NoReply.
+
+Handlers run as requests (see HandleRequest), so ctx carries the request timeout.
+
+	type JoinRequest struct {
+		Room string `json:"room"`
+	}
+
+	type JoinResponse struct {
+		Members int `json:"members"`
+	}
+
+	websockets.Handle(wsServer, "join", func(ctx context.Context, client *websockets.Client, req JoinRequest) (JoinResponse, error) {
+		return JoinResponse{Members: 3}, nil
+	})
+
+	websockets.Handle(wsServer, "typing", func(ctx context.Context, client *websockets.Client, req Typing) (websockets.NoReply, error) {
+		return websockets.NoReply{}, nil
+	})
+*/
+func Handle[T any, R any](s *WsServer, msgType string, fn func(ctx context.Context, client *Client, req T) (R, error), options ...RequestOption) {
+	s.HandleRequest(msgType, func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+		var req T
+		if len(msg.Payload) > 0 {
+			if err := client.Decode(msg.Payload, &req); err != nil {
+				return nil, NewError(CodeInvalidPayload, err.Error())
+			}
+		}
+
+		if err := validate(&req); err != nil {
+			return nil, NewError(CodeValidationFailed, err.Error())
+		}
+
+		return fn(ctx, client, req)
+	}, options...)
+}
+
+// validate calls Validate on the decoded request if either T or *T implements Validator
+func validate[T any](req *T) error {
+	if v, ok := any(*req).(Validator); ok {
+		return v.Validate()
+	}
+	if v, ok := any(req).(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// replyError sends the error frame to the client and returns the error, marked as sent, to the caller
+func (s *WsServer) replyError(client *Client, msg *Envelope, err error) error {
+	return replied{error: err, delivered: s.sendError(client, msg, err)}
+}
+
+// sendError sends the error frame to the client, reporting whether it was queued
+func (s *WsServer) sendError(client *Client, msg *Envelope, err error) bool {
+	if sendErr := client.SendError(msg, err); sendErr != nil {
+		log.Printf("Failed to send error frame: %v", sendErr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type joinRequest struct {
+	Room string `json:"room"`
+}
+
+func (r joinRequest) Validate() error {
+	if r.Room == "" {
+		return errors.New("room is required")
+	}
+	return nil
+}
+
+type joinResponse struct {
+	Room    string `json:"room"`
+	Members int    `json:"members"`
+}
+
+func TestHandleTyped(t *testing.T) {
+	s := New("0")
+	Handle(s, "join", func(ctx context.Context, client *Client, req joinRequest) (joinResponse, error) {
+		return joinResponse{Room: req.Room, Members: 1}, nil
+	})
+	conn := dialTestServer(t, s)
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "join", "id": "1", "payload": map[string]string{"room": "lobby"}}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if env.Type != "join" || env.ID != "1" || string(env.Payload) != `{"room":"lobby","members":1}` {
+		t.Fatalf("unexpected response: %+v %s", env, env.Payload)
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "join", "id": "2", "payload": map[string]string{}}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var errEnv struct {
+		Type    string `json:"type"`
+		ID      string `json:"id"`
+		Payload Error  `json:"payload"`
+	}
+	if err := conn.ReadJSON(&errEnv); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if errEnv.Type != "error" || errEnv.ID != "2" || errEnv.Payload.Code != CodeValidationFailed {
+		t.Fatalf("unexpected error frame: %+v", errEnv)
+	}
+}
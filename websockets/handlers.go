@@ -1,114 +1,203 @@
 package websockets
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
 
 // All client requests are sent to this Handler - then this distributes the request to the appropriate handler
 func (s *WsServer) RootSocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.UpgradeHTTPConntoWebSockets(w, r)
+	client, err := s.UpgradeHTTPConntoWebSockets(w, r)
 	if err != nil {
 		log.Printf("Failed to upgrade: %v", err)
 		return
 	}
-	defer s.RemoveConnection(conn)
-
-	// Keep Reading Messages from the Client connection
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil { // If Error reading message - handle Error
-			if _, expected := handleSocketError(err, &websocket.CloseError{}, &net.OpError{}); expected {
-				log.Printf("Successfully Closed the Connection")
-				break
+	var readErr error
+	defer func() {
+		s.RemoveConnection(client.Conn)
+		s.disconnected(client, readErr)
+	}()
+	if !s.connected(client) {
+		return
+	}
+
+	// Messages are read ahead of the handlers, so a disconnect cancels the ctx of the message being handled
+	frames := make(chan []byte)
+	go func() {
+		defer close(frames)
+		for {
+			_, msg, err := client.Conn.ReadMessage()
+			if err != nil {
+				readErr = err
+				client.cancel()
+				return
+			}
+			client.received()
+			select {
+			case frames <- msg:
+			case <-client.done:
+				return
 			}
 		}
+	}()
+	defer s.readFailed(client, &readErr)
 
+	// Handle the Messages from the Client connection one at a time
+	for msg := range frames {
 		log.Printf("+1 Sent.")
 		s.counter.IncrementTotalMessagesReceived()
-		var messageData map[string]interface{}
-		if err := json.Unmarshal(msg, &messageData); err != nil {
+		atomic.AddInt64(&client.messagesReceived, 1)
+		s.counter.AddBytesReceived(len(msg))
+
+		if _, jsonRPC := client.Codec.(JSONRPCCodec); jsonRPC {
+			atomic.AddInt64(&s.handlersInFlight, 1)
+			s.serveJSONRPC(client, msg)
+			atomic.AddInt64(&s.handlersInFlight, -1)
+			continue
+		}
+
+		// Frames are limited before they are decoded, so undecodable ones cost as much of the limit as any other
+		if !client.limiter.allowFrame() {
+			var wsErr *Error
+			errors.As(s.rateLimitExceeded(client, ""), &wsErr)
+			s.rejectMessage(client, nil, wsErr)
+			continue
+		}
+
+		var env Envelope
+		if err := client.Codec.Decode(msg, &env); err != nil {
 			log.Printf("Failed to parse message: %v", err)
+			s.rejectMessage(client, nil, NewError(CodeInvalidMessage, "message could not be decoded"))
+			continue
+		}
+
+		if !client.limiter.allowType(env.Type) {
+			var wsErr *Error
+			errors.As(s.rateLimitExceeded(client, env.Type), &wsErr)
+			s.rejectMessage(client, &env, wsErr)
+			continue
+		}
+
+		if s.isDraining() {
+			s.replyError(client, &env, NewError(CodeUnavailable, ErrShuttingDown.Error()))
 			continue
 		}
 
 		// Map message type to appropriate Handler
-		if handlerFunc, exists := s.WSConnHandlers[messageData["type"].(string)]; exists {
-			handlerFunc(conn, messageData["payload"])
+		if handlerFunc, exists := s.handler(env.Type); exists {
+			atomic.AddInt64(&s.handlersInFlight, 1)
+			ctx, cancel := s.messageContext(client, &env)
+			switch err := handlerFunc(ctx, client, &env); {
+			case err == nil:
+				client.clientErrors = 0
+			case errors.Is(err, errClientGone):
+				// There is nobody left to reply to
+			default:
+				log.Printf("Handler for %q failed: %v", env.Type, err)
+				s.reportError(client, err)
+				s.handlerFailed(client, &env, err)
+			}
+			cancel()
+			atomic.AddInt64(&s.handlersInFlight, -1)
 		} else {
-			log.Printf("Unsupported message type: %s", messageData["type"])
+			log.Printf("Unsupported message type: %q", env.Type)
+			s.rejectMessage(client, &env, NewError(CodeUnsupportedType, fmt.Sprintf("unsupported message type %q", env.Type)))
 		}
 	}
 }
 
-func (s *WsServer) EchoHandler(conn *websocket.Conn, payload interface{}) {
-	// Placeholder for the echo functionality
-	message, ok := payload.(string)
-	if !ok {
-		log.Println("Failed to cast payload to string")
-		return
-	}
-	// Convert the message into JSON format
-	response := map[string]interface{}{
-		"type":    "echo",
-		"payload": message,
+// readFailed handles the error that ended the read loop
+func (s *WsServer) readFailed(client *Client, readErr *error) {
+	err := *readErr
+	switch {
+	case err == nil:
+		// The Client was removed by the server
+	case isHeartbeatTimeout(err):
+		log.Printf("Client missed heartbeat, closing the Connection")
+		s.counter.IncrementHeartbeatTimeouts()
+		client.disconnect(websocket.CloseGoingAway, "heartbeat timeout")
+		s.reportError(client, err)
+	case errors.Is(err, websocket.ErrReadLimit):
+		log.Printf("Client sent a message over the read limit, closing the Connection")
+		s.counter.IncrementOversizedMessages()
+		// The close frame was sent by the websocket library
+		client.closing(websocket.CloseMessageTooBig, "")
+		s.reportError(client, err)
+	default:
+		if _, expected := handleSocketError(err, &websocket.CloseError{}, &net.OpError{}); expected {
+			log.Printf("Successfully Closed the Connection")
+		} else {
+			s.reportError(client, err)
+		}
 	}
+}
 
-	responseData, err := json.Marshal(response)
-	if err != nil {
-		log.Printf("Failed to marshal response: %v", err)
-		return
+func (s *WsServer) EchoHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	var message string
+	if err := client.Decode(msg.Payload, &message); err != nil {
+		return err
 	}
 
-	err = conn.WriteMessage(websocket.TextMessage, responseData)
-	if err != nil {
+	if err := client.Send("echo", message); err != nil {
 		log.Printf("Failed to send echo message: %v", err)
+		return err
 	}
-	s.counter.IncrementTotalMessagesSent()
+	return nil
 }
 
-func (s *WsServer) BroadcastHandler(conn *websocket.Conn, payload interface{}) {
-	message, ok := payload.(string)
-	if !ok {
-		log.Println("Failed to cast payload to string")
-		return
+func (s *WsServer) BroadcastHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	var message string
+	if err := client.Decode(msg.Payload, &message); err != nil {
+		return err
 	}
 
-	s.activeClientsMu.RLock() // Ensure to use the Read Lock since you're only reading from the map
-	defer s.activeClientsMu.RUnlock()
+	s.broadcast(message)
+	s.forward(brokerBroadcast, "", func() ([]byte, error) {
+		return json.Marshal(message)
+	})
+	return nil
+}
 
-	for client := range s.activeClients {
-		client.Mu.Lock()
-		err := client.Conn.WriteJSON(map[string]interface{}{
-			"type":    "broadcast",
-			"payload": message,
+// broadcast sends the message to every Client connected to this instance
+func (s *WsServer) broadcast(message string) {
+	var metadata map[string]string
+	var clients []*Client
+	if h := s.history; h != nil {
+		payloads := s.encodeAll(func(codec Codec) ([]byte, error) {
+			return codec.Marshal(message)
 		})
+		h.mu.Lock()
+		metadata = map[string]string{seqMetadataKey: h.append(broadcastStream, payloads)}
+		clients = s.clients()
+		h.mu.Unlock()
+	} else {
+		clients = s.clients()
+	}
+
+	// Messages are queued for each client's writer goroutine, so a slow client never stalls the broadcast
+	for _, c := range clients {
+		payload, err := c.Codec.Marshal(message)
+		if err == nil {
+			err = c.deliver(&Envelope{Type: "broadcast", Payload: payload, Metadata: metadata})
+		}
 		if err != nil {
 			log.Printf("Failed to broadcast message to a client: %v", err)
 		}
-		client.Mu.Unlock()
-
-		s.counter.IncrementTotalMessagesSent()
 	}
 }
 
-func (s *WsServer) HealthCheckHandler(conn *websocket.Conn, payload interface{}) {
-	response := map[string]interface{}{
-		"type":    "healthcheck",
-		"payload": "Server is running",
-	}
-	responseData, err := json.Marshal(response)
-	if err != nil {
-		log.Printf("Failed to marshal healthcheck response: %v", err)
-		return
-	}
-	err = conn.WriteMessage(websocket.TextMessage, responseData)
-	if err != nil {
+func (s *WsServer) HealthCheckHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	if err := client.Send("healthcheck", "Server is running"); err != nil {
 		log.Printf("Failed to send healthcheck response: %v", err)
+		return err
 	}
-	s.counter.IncrementTotalMessagesSent()
+	return nil
 }
@@ -0,0 +1,123 @@
+package websockets
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+HeartbeatConfig controls how the server detects dead and idle connections.
+
+  - PingInterval - how often a ping is sent to the client
+  - PongWait - how long the server waits for any frame (including a pong) before the connection is considered dead
+  - WriteTimeout - deadline for every write to the connection
+  - IdleTimeout - closes connections that have not sent a message in this long. Pongs do not count. Zero disables it.
+
+Zero values disable the corresponding check. PingInterval must be shorter than PongWait.
+*/
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongWait     time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+var defaultHeartbeat = HeartbeatConfig{
+	PingInterval: 54 * time.Second,
+	PongWait:     60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+/*
+Heartbeat configures ping/pong, read and write deadlines and the idle timeout for connections.
+
+By default a ping is sent every 54s, clients have 60s to respond and writes time out after 10s.
+Connections that miss heartbeats are closed with websocket.CloseGoingAway and idle connections
+with websocket.CloseNormalClosure.
+
+	wsServer := server.New("8080").EnableAll().Heartbeat(websockets.HeartbeatConfig{
+		PingInterval: 10 * time.Second,
+		PongWait:     15 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  5 * time.Minute,
+	})
+*/
+func (s *WsServer) Heartbeat(config HeartbeatConfig) *WsServer {
+	if config.PongWait > 0 && (config.PingInterval <= 0 || config.PingInterval >= config.PongWait) {
+		config.PingInterval = config.PongWait * 9 / 10
+	}
+	s.heartbeat = config
+	return s
+}
+
+// startHeartbeat sets the initial read deadline and extends it whenever a pong is received
+func (c *Client) startHeartbeat() {
+	c.touch()
+	if c.heartbeat.PongWait <= 0 {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(c.heartbeat.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.heartbeat.PongWait))
+	})
+}
+
+// received extends the read deadline and records activity after a message is read from the client
+func (c *Client) received() {
+	c.touch()
+	if c.heartbeat.PongWait > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.heartbeat.PongWait))
+	}
+}
+
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// untilIdle returns how long until the client has not sent a message within the IdleTimeout, it is idle once
+// this is not positive
+func (c *Client) untilIdle() time.Duration {
+	lastActivity := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	return c.heartbeat.IdleTimeout - time.Since(lastActivity)
+}
+
+// closeIdle is called by the writer goroutine once the client is idle
+func (c *Client) closeIdle() {
+	log.Printf("Closing idle connection")
+	c.server.counter.IncrementIdleTimeouts()
+	c.disconnect(websocket.CloseNormalClosure, "idle timeout")
+}
+
+// writeDeadline returns the deadline for the next write, or the zero time if writes never time out
+func (c *Client) writeDeadline() time.Time {
+	if c.heartbeat.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.heartbeat.WriteTimeout)
+}
+
+// ping is called by the writer goroutine on every PingInterval. It returns false once the connection has been closed.
+func (c *Client) ping() bool {
+	err := c.Conn.WriteControl(websocket.PingMessage, nil, c.writeDeadline())
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to send ping: %v", err)
+		c.Conn.Close()
+		return false
+	}
+	return true
+}
+
+// isHeartbeatTimeout reports whether a read failed because the read deadline expired
+func isHeartbeatTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
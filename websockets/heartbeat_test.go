@@ -0,0 +1,52 @@
+package websockets
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHeartbeatClosesDeadConnections(t *testing.T) {
+	s := New("0").Heartbeat(HeartbeatConfig{
+		PingInterval: 20 * time.Millisecond,
+		PongWait:     50 * time.Millisecond,
+	})
+	conn := dialTestServer(t, s)
+
+	// Swallow pings without answering them to simulate a half-open connection
+	conn.SetPingHandler(func(string) error { return nil })
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("got %v, want heartbeat close", err)
+	}
+	if got := atomic.LoadInt64(&s.counter.totalHeartbeatTimeout); got != 1 {
+		t.Fatalf("counted %d heartbeat timeouts, want 1", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, config := range []HeartbeatConfig{
+		{PingInterval: 20 * time.Millisecond, PongWait: time.Second, IdleTimeout: 50 * time.Millisecond},
+		// Neither depends on pings
+		{IdleTimeout: 50 * time.Millisecond},
+		{PingInterval: 5 * time.Second, PongWait: 10 * time.Second, IdleTimeout: 50 * time.Millisecond},
+	} {
+		s := New("0").Heartbeat(config)
+		conn := dialTestServer(t, s)
+
+		start := time.Now()
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("%+v: got %v, want idle close", config, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%+v: closed after %s", config, elapsed)
+		}
+		if got := atomic.LoadInt64(&s.counter.totalIdleTimeouts); got != 1 {
+			t.Fatalf("%+v: counted %d idle timeouts, want 1", config, got)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestServer serves s on an httptest.Server and connects a client to it
+func dialTestServer(t *testing.T, s *WsServer) *websocket.Conn {
+	t.Helper()
+	return newTestServer(t, s).dial("")
+}
+
+// testServer serves a handler on an httptest.Server that is closed when the test ends
+type testServer struct {
+	t *testing.T
+	// url is the ws:// URL of the websocket endpoint and httpURL the http:// URL of the server
+	url     string
+	httpURL string
+}
+
+func newTestServer(t *testing.T, handler http.Handler) *testServer {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return &testServer{t: t, url: "ws" + strings.TrimPrefix(ts.URL, "http"), httpURL: ts.URL}
+}
+
+// userAuthenticator authenticates connections as the user in their user query parameter
+func userAuthenticator() Authenticator {
+	return QueryParam("user", func(token string) (*Principal, error) {
+		return &Principal{UserID: token}, nil
+	})
+}
+
+// userURL is the URL to connect as the user with the userAuthenticator, or anonymously when user is empty
+func (ts *testServer) userURL(user string) string {
+	if user == "" {
+		return ts.url
+	}
+	return ts.url + "/?user=" + user
+}
+
+// connect opens a connection to the URL negotiating the subprotocols, it is closed when the test ends
+func (ts *testServer) connect(url string, header http.Header, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, resp, err := dialer.Dial(url, header)
+	if err == nil {
+		ts.t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// dial connects as the user, failing the test if the upgrade fails
+func (ts *testServer) dial(user string) *websocket.Conn {
+	ts.t.Helper()
+	conn, resp, err := ts.connect(ts.userURL(user), nil)
+	if err != nil {
+		if resp != nil {
+			ts.t.Fatalf("Dial %q: %v (HTTP %d)", user, err, resp.StatusCode)
+		}
+		ts.t.Fatalf("Dial %q: %v", user, err)
+	}
+	return conn
+}
+
+// reject connects as the user, failing the test unless the upgrade is rejected, and returns the HTTP response
+func (ts *testServer) reject(user string) *http.Response {
+	ts.t.Helper()
+	_, resp, err := ts.connect(ts.userURL(user), nil)
+	if err == nil {
+		ts.t.Fatalf("Dial %q was upgraded, want it rejected", user)
+	}
+	if resp == nil {
+		ts.t.Fatalf("Dial %q: %v", user, err)
+	}
+	return resp
+}
@@ -0,0 +1,365 @@
+package websockets
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	seqMetadataKey     = "seq"
+	lastSeqMetadataKey = "last_seq"
+	epochMetadataKey   = "epoch"
+
+	// broadcastStream is the history of broadcasts, topics cannot be empty so it never collides with one
+	broadcastStream = ""
+)
+
+/*
+HistoryConfig configures the messages retained for clients resuming after a reconnect.
+*/
+type HistoryConfig struct {
+	// Size is the number of messages retained per topic, and for broadcasts
+	Size int
+	// Topics are the patterns of the topics a history is kept for, every topic when empty
+	Topics []string
+	// MaxTopics is the number of topics a history is kept for, the least recently published is dropped first.
+	// Defaults to 1000.
+	MaxTopics int
+}
+
+/*
+History retains the latest messages of every topic and of broadcasts so reconnecting clients can catch up.
+
+Every published and broadcast message carries a sequence number in its metadata, and subscribe acknowledgements
+carry the server's epoch, which changes when the server restarts
+
+	{"type": "publish", "metadata": {"topic": "chat.lobby", "seq": "42"}, "payload": "Hello"}
+	{"type": "subscribe", "id": "1", "metadata": {"topic": "chat.*", "seq": "42", "epoch": "9f2c4e1a7b3d5f60"}}
+
+A client resumes by subscribing with the last sequence number and epoch it saw, and receives the messages it missed
+before any new ones
+
+	{"type": "subscribe", "id": "1", "metadata": {"topic": "chat.*", "last_seq": "40", "epoch": "9f2c4e1a7b3d5f60"}}
+
+Broadcasts are resumed with the resume message type
+
+	{"type": "resume", "id": "2", "metadata": {"last_seq": "40", "epoch": "9f2c4e1a7b3d5f60"}}
+
+When the missed messages are no longer retained, or the epoch is different, the client receives a reset instead
+and should reload its state from the source of truth
+
+	{"type": "reset", "id": "1", "metadata": {"topic": "chat.*", "seq": "97", "epoch": "9f2c4e1a7b3d5f60"}}
+
+A history is kept for the topics matching Topics, and at most MaxTopics of them. Clients resuming from before a
+dropped topic's last message are reset, so set Topics when clients choose the topics they publish to. Sequence
+numbers are per server instance, so with a Broker a client that reconnects to another instance is reset.
+
+	wsServer := server.New("8080").EnableAll().History(websockets.HistoryConfig{Size: 500, Topics: []string{"chat.*"}})
+
+Messages published concurrently may be queued out of sequence order, messages published one after the other,
+such as by the handlers of one client, are not.
+*/
+func (s *WsServer) History(config HistoryConfig) *WsServer {
+	if config.Size <= 0 {
+		config.Size = 100
+	}
+	if config.MaxTopics <= 0 {
+		config.MaxTopics = 1000
+	}
+	s.history = &history{
+		size:      config.Size,
+		topics:    config.Topics,
+		maxTopics: config.MaxTopics,
+		streams:   make(map[string]*ring),
+		lru:       list.New(),
+	}
+	s.HandleFunc("resume", s.ResumeHandler)
+	return s
+}
+
+// history holds a ring buffer per topic. The lock only covers assigning sequence numbers and collecting the
+// recipients, messages are delivered once it is released.
+type history struct {
+	mu        sync.Mutex
+	size      int
+	topics    []string
+	maxTopics int
+	seq       uint64
+	streams   map[string]*ring
+	// lru holds the topics from the most to the least recently published, the broadcast stream is never dropped
+	lru *list.List
+	// dropped is the sequence number of the newest message of the topics dropped to stay within maxTopics
+	dropped uint64
+}
+
+type historyEntry struct {
+	seq   uint64
+	topic string
+	// payloads is the message encoded by each Codec when it was published
+	payloads map[string][]byte
+}
+
+type ring struct {
+	entries []historyEntry
+	next    int
+	// evicted is the sequence number of the newest message no longer retained
+	evicted uint64
+	// last is the sequence number of the newest message
+	last uint64
+	elem *list.Element
+}
+
+// append records the message encoded by encodeAll and returns its sequence number as metadata, or "" when no
+// history is kept for the stream. h.mu must be held.
+func (h *history) append(stream string, payloads map[string][]byte) string {
+	if !h.keeps(stream) {
+		return ""
+	}
+	h.seq++
+	r, ok := h.streams[stream]
+	switch {
+	case !ok:
+		r = &ring{}
+		h.streams[stream] = r
+		if stream != broadcastStream {
+			r.elem = h.lru.PushFront(stream)
+			if h.lru.Len() > h.maxTopics {
+				h.drop(h.lru.Back())
+			}
+		}
+	case r.elem != nil:
+		h.lru.MoveToFront(r.elem)
+	}
+	r.last = h.seq
+
+	entry := historyEntry{seq: h.seq, topic: stream, payloads: payloads}
+	if len(r.entries) < h.size {
+		r.entries = append(r.entries, entry)
+	} else {
+		r.evicted = r.entries[r.next].seq
+		r.entries[r.next] = entry
+		r.next = (r.next + 1) % h.size
+	}
+	return strconv.FormatUint(h.seq, 10)
+}
+
+func (h *history) keeps(stream string) bool {
+	if stream == broadcastStream || len(h.topics) == 0 {
+		return true
+	}
+	for _, pattern := range h.topics {
+		if topicMatches(pattern, stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// drop forgets the history of the topic
+func (h *history) drop(elem *list.Element) {
+	stream := h.lru.Remove(elem).(string)
+	if r := h.streams[stream]; r.last > h.dropped {
+		h.dropped = r.last
+	}
+	delete(h.streams, stream)
+}
+
+// since returns the messages after lastSeq in the streams accepted by match, ok is false if some were evicted
+func (h *history) since(lastSeq uint64, match func(stream string) bool) (entries []historyEntry, ok bool) {
+	if lastSeq > h.seq {
+		return nil, false
+	}
+	for stream, r := range h.streams {
+		if !match(stream) {
+			continue
+		}
+		if r.evicted > lastSeq {
+			return nil, false
+		}
+		for _, entry := range r.entries {
+			if entry.seq > lastSeq {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries, true
+}
+
+// resumeFrom parses the resume metadata, resume is false when the client did not ask to resume
+func resumeFrom(msg *Envelope) (lastSeq uint64, epoch string, resume bool, err error) {
+	value, resume := msg.Metadata[lastSeqMetadataKey]
+	if !resume {
+		return 0, "", false, nil
+	}
+	lastSeq, err = strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, "", false, NewError(CodeBadRequest, "last_seq must be a sequence number")
+	}
+	return lastSeq, msg.Metadata[epochMetadataKey], true, nil
+}
+
+// subscribeWithHistory subscribes the Client and replays the messages it missed
+func (s *WsServer) subscribeWithHistory(client *Client, msg *Envelope, pattern string) error {
+	lastSeq, epoch, resume, err := resumeFrom(msg)
+	if err != nil {
+		return s.replyError(client, msg, err)
+	}
+
+	h := s.history
+	h.mu.Lock()
+	joined, err := s.subscribe(client, pattern)
+	if err != nil {
+		h.mu.Unlock()
+		return s.replyError(client, msg, NewError(CodeInvalidTopic, err.Error()))
+	}
+	position := s.historyMetadata(pattern)
+	var entries []historyEntry
+	complete := true
+	if resume {
+		entries, complete = h.since(lastSeq, func(stream string) bool {
+			return stream != broadcastStream && topicMatches(pattern, stream)
+		})
+		complete = complete && lastSeq >= h.dropped
+	}
+	// Messages published once the lock is released are held back until the replay is written
+	client.startReplay()
+	h.mu.Unlock()
+	defer client.endReplay()
+
+	if joined {
+		s.presenceJoin(pattern, client)
+	}
+	if err := client.WriteEnvelope(&Envelope{Type: msg.Type, ID: msg.ID, Metadata: position}); err != nil {
+		return err
+	}
+	if !resume {
+		return nil
+	}
+	return s.replay(client, msg, position, entries, complete && epoch == s.nodeID)
+}
+
+/*
+ResumeHandler replays the broadcasts a client missed, see History.
+*/
+func (s *WsServer) ResumeHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	if s.history == nil {
+		return s.replyError(client, msg, NewError(CodeUnavailable, "history is not enabled"))
+	}
+	lastSeq, epoch, _, err := resumeFrom(msg)
+	if err != nil {
+		return s.replyError(client, msg, err)
+	}
+
+	h := s.history
+	h.mu.Lock()
+	position := s.historyMetadata("")
+	entries, complete := h.since(lastSeq, func(stream string) bool {
+		return stream == broadcastStream
+	})
+	client.startReplay()
+	h.mu.Unlock()
+	defer client.endReplay()
+
+	return s.replay(client, msg, position, entries, complete && epoch == s.nodeID)
+}
+
+// replay writes the missed messages, or a reset with the position when they are incomplete
+func (s *WsServer) replay(client *Client, msg *Envelope, position map[string]string, entries []historyEntry, complete bool) error {
+	if !complete {
+		return client.WriteEnvelope(&Envelope{Type: "reset", ID: msg.ID, Metadata: position})
+	}
+
+	for _, entry := range entries {
+		payload, ok := entry.payloads[client.Codec.Name()]
+		if !ok {
+			var err error
+			if payload, err = transcode(entry.payloads[JSONCodec{}.Name()], JSONCodec{}, client.Codec); err != nil {
+				return err
+			}
+		}
+		env := &Envelope{Type: "publish", Payload: payload, Metadata: map[string]string{
+			topicMetadataKey: entry.topic,
+			seqMetadataKey:   strconv.FormatUint(entry.seq, 10),
+		}}
+		if entry.topic == broadcastStream {
+			env.Type, env.Metadata = "broadcast", map[string]string{seqMetadataKey: env.Metadata[seqMetadataKey]}
+		}
+		if err := client.WriteEnvelope(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startReplay holds back the messages delivered to the Client until endReplay. It is called with the history
+// lock held, so it does not wait for replayMu.
+func (c *Client) startReplay() {
+	atomic.AddInt32(&c.replaying, 1)
+}
+
+// endReplay queues the messages held back during the replay
+func (c *Client) endReplay() {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	if atomic.AddInt32(&c.replaying, -1) > 0 {
+		return
+	}
+	for _, env := range c.pending {
+		if err := c.WriteEnvelope(env); err != nil {
+			log.Printf("Failed to deliver a message held back by a replay: %v", err)
+		}
+	}
+	c.pending = nil
+}
+
+// deliver queues a published or broadcast message, holding it back while the Client receives a replay
+func (c *Client) deliver(env *Envelope) error {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	if atomic.LoadInt32(&c.replaying) > 0 {
+		c.pending = append(c.pending, env)
+		return nil
+	}
+	return c.WriteEnvelope(env)
+}
+
+// encodeAll marshals a message with every Codec clients can negotiate, so the history keeps the message as it
+// was when it was published
+func (s *WsServer) encodeAll(payloadFor func(codec Codec) ([]byte, error)) map[string][]byte {
+	codecs := []Codec{JSONCodec{}, s.defaultCodec}
+	for _, codec := range s.codecs {
+		codecs = append(codecs, codec)
+	}
+
+	payloads := make(map[string][]byte, len(codecs))
+	for _, codec := range codecs {
+		if _, ok := payloads[codec.Name()]; ok {
+			continue
+		}
+		payload, err := payloadFor(codec)
+		if err != nil {
+			log.Printf("Failed to marshal a message for the history with the %s codec: %v", codec.Name(), err)
+			continue
+		}
+		payloads[codec.Name()] = payload
+	}
+	return payloads
+}
+
+// historyMetadata describes the current position of the history, s.history.mu must be held
+func (s *WsServer) historyMetadata(pattern string) map[string]string {
+	metadata := map[string]string{
+		seqMetadataKey:   strconv.FormatUint(s.history.seq, 10),
+		epochMetadataKey: s.nodeID,
+	}
+	if pattern != "" {
+		metadata[topicMetadataKey] = pattern
+	}
+	return metadata
+}
@@ -0,0 +1,185 @@
+package websockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryResume(t *testing.T) {
+	s := New("0").EnableAll().History(HistoryConfig{Size: 2})
+
+	subscribe := func(metadata map[string]string) (*Envelope, []Envelope) {
+		t.Helper()
+		conn := dialTestServer(t, s)
+		metadata["topic"] = "chat.*"
+		conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: metadata})
+		// A healthcheck marks the end of the replay
+		conn.WriteJSON(Envelope{Type: "healthcheck"})
+
+		var ack Envelope
+		conn.ReadJSON(&ack)
+		var replayed []Envelope
+		for {
+			var env Envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				t.Fatalf("ReadJSON: %v", err)
+			}
+			if env.Type == "healthcheck" {
+				return &ack, replayed
+			}
+			replayed = append(replayed, env)
+		}
+	}
+
+	ack, _ := subscribe(map[string]string{})
+	epoch := ack.Metadata["epoch"]
+	if ack.Metadata["seq"] != "0" || epoch == "" {
+		t.Fatalf("ack = %+v", ack)
+	}
+
+	s.Publish("chat.lobby", "one")
+	s.Publish("news.today", "skipped")
+	s.Publish("chat.help", "two")
+
+	_, replayed := subscribe(map[string]string{"last_seq": "1", "epoch": epoch})
+	if len(replayed) != 1 || replayed[0].Metadata["seq"] != "3" || replayed[0].Metadata["topic"] != "chat.help" {
+		t.Fatalf("replayed = %+v", replayed)
+	}
+
+	s.Publish("chat.lobby", "three")
+	s.Publish("chat.lobby", "four")
+	for _, metadata := range []map[string]string{
+		{"last_seq": "0", "epoch": epoch},          // "one" was evicted
+		{"last_seq": "4", "epoch": "other-server"}, // restarted or another instance
+	} {
+		_, replayed := subscribe(metadata)
+		if len(replayed) != 1 || replayed[0].Type != "reset" || replayed[0].Metadata["seq"] != "5" {
+			t.Fatalf("replayed = %+v, want reset", replayed)
+		}
+	}
+}
+
+func TestDialResumesHistory(t *testing.T) {
+	s := New("0").EnableAll().History(HistoryConfig{Size: 10})
+	ts := newTestServer(t, s)
+
+	connected, disconnected := make(chan struct{}, 4), make(chan struct{}, 4)
+	conn, err := Dial(ts.url, DialOptions{
+		MinBackoff:   10 * time.Millisecond,
+		OnConnect:    func(*ClientConn) { connected <- struct{}{} },
+		OnDisconnect: func(error) { disconnected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	<-connected
+
+	messages := make(chan string, 4)
+	On(conn, "publish", func(msg string) { messages <- msg })
+	conn.Subscribe("chat.*")
+	for len(s.subscribers("chat.lobby")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Publish("chat.lobby", "before")
+	if msg := <-messages; msg != "before" {
+		t.Fatalf("message = %q", msg)
+	}
+
+	s.TerminateConnections()
+	<-disconnected
+	s.Publish("chat.lobby", "missed")
+
+	select {
+	case msg := <-messages:
+		if msg != "missed" {
+			t.Fatalf("message = %q", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("missed message was not replayed")
+	}
+}
+
+func TestHistoryTopicLimits(t *testing.T) {
+	s := New("0").EnableAll().History(HistoryConfig{Size: 10, Topics: []string{"chat.*"}, MaxTopics: 2})
+	h := s.history
+
+	s.Publish("news.today", "not kept")
+	if len(h.streams) != 0 || h.seq != 0 {
+		t.Fatalf("kept a history for a topic outside Topics: %d streams, seq %d", len(h.streams), h.seq)
+	}
+
+	s.Publish("chat.a", "one")
+	s.Publish("chat.b", "two")
+	s.Publish("chat.a", "three")
+	s.Publish("chat.c", "four") // drops chat.b, the least recently published
+	if _, ok := h.streams["chat.b"]; ok || len(h.streams) != 2 || h.dropped != 2 {
+		t.Fatalf("streams = %v, dropped = %d", h.streams, h.dropped)
+	}
+
+	conn := dialTestServer(t, s)
+	resume := func(lastSeq string) Envelope {
+		t.Helper()
+		conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{
+			"topic": "chat.*", "last_seq": lastSeq, "epoch": s.nodeID,
+		}})
+		var ack, next Envelope
+		conn.ReadJSON(&ack)
+		conn.ReadJSON(&next)
+		return next
+	}
+	if next := resume("1"); next.Type != "reset" {
+		t.Fatalf("resuming from before a dropped topic replayed %+v, want reset", next)
+	}
+	if next := resume("2"); next.Type != "publish" || next.Metadata["seq"] != "3" {
+		t.Fatalf("resuming after the dropped topic replayed %+v", next)
+	}
+}
+
+func TestHistoryKeepsPublishedPayload(t *testing.T) {
+	s := New("0").EnableAll().History(HistoryConfig{Size: 10})
+	message := map[string]string{"text": "published"}
+	s.Publish("chat.lobby", message)
+	message["text"] = "changed afterwards"
+
+	conn := dialTestServer(t, s)
+	conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{
+		"topic": "chat.*", "last_seq": "0", "epoch": s.nodeID,
+	}})
+	var ack, replayed Envelope
+	conn.ReadJSON(&ack)
+	if err := conn.ReadJSON(&replayed); err != nil || string(replayed.Payload) != `{"text":"published"}` {
+		t.Fatalf("replayed %s, %v, want the message as it was published", replayed.Payload, err)
+	}
+}
+
+func TestHistorySubscribeDuringSlowDelivery(t *testing.T) {
+	s := New("0").EnableAll().History(HistoryConfig{Size: 10}).
+		SendQueue(SendQueueConfig{Size: 1, Policy: BlockWithTimeout, BlockTimeout: 2 * time.Second})
+	conn := dialTestServer(t, s)
+	conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": "chat.a"}})
+	conn.ReadJSON(&Envelope{})
+
+	// Holding the write lock stalls the writer goroutine: it holds the first message, the second fills the queue
+	// and the third waits for room
+	client := s.clients()[0]
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+	for i := 0; i < 3; i++ {
+		go s.Publish("chat.a", i)
+	}
+	for len(client.send) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Subscribing while a delivery to the client waits for room does not hold up other publishes
+	conn.WriteJSON(Envelope{Type: "subscribe", ID: "2", Metadata: map[string]string{"topic": "chat.b", "last_seq": "0"}})
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	s.Publish("news.today", "hello")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Publish waited %s for a subscribe to a slow client", elapsed)
+	}
+}
@@ -0,0 +1,122 @@
+package websockets
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+ConnectHook is called once a Client is connected, before its messages are handled.
+
+Returning an error closes the connection with websocket.CloseInternalServerErr.
+*/
+type ConnectHook func(client *Client, r *http.Request) error
+
+/*
+DisconnectHook is called once a Client is disconnected and removed from the server.
+*/
+type DisconnectHook func(client *Client, info DisconnectInfo)
+
+/*
+ErrorHook is called with the errors reading from a Client that are not a normal close, and the errors
+returned by handlers.
+*/
+type ErrorHook func(client *Client, err error)
+
+/*
+DisconnectInfo describes how a connection was closed.
+
+Code and Reason are from the close frame sent by the server, or else the one received from the client.
+Connections dropped without a close frame have the code websocket.CloseAbnormalClosure.
+*/
+type DisconnectInfo struct {
+	Code   int
+	Reason string
+	// Err is the error that ended the read loop
+	Err error
+}
+
+/*
+OnConnect registers a hook called for every connection accepted by the server.
+
+	wsServer := server.New("8080").EnableAll().OnConnect(func(client *websockets.Client, r *http.Request) error {
+		return sessions.Load(client.ID, client.Principal.UserID)
+	})
+*/
+func (s *WsServer) OnConnect(hook ConnectHook) *WsServer {
+	s.connectHooks = append(s.connectHooks, hook)
+	return s
+}
+
+/*
+OnDisconnect registers a hook called for every connection once it is closed, including connections closed
+by a failing ConnectHook.
+
+	wsServer := server.New("8080").EnableAll().OnDisconnect(func(client *websockets.Client, info websockets.DisconnectInfo) {
+		sessions.Release(client.ID)
+	})
+*/
+func (s *WsServer) OnDisconnect(hook DisconnectHook) *WsServer {
+	s.disconnectHooks = append(s.disconnectHooks, hook)
+	return s
+}
+
+/*
+OnError registers a hook called with unexpected connection errors and handler errors.
+*/
+func (s *WsServer) OnError(hook ErrorHook) *WsServer {
+	s.errorHooks = append(s.errorHooks, hook)
+	return s
+}
+
+// connected runs the connect hooks, closing the connection if one fails
+func (s *WsServer) connected(client *Client) bool {
+	for _, hook := range s.connectHooks {
+		if err := hook(client, client.Request); err != nil {
+			log.Printf("Connect hook failed: %v", err)
+			client.disconnect(websocket.CloseInternalServerErr, "connection setup failed")
+			return false
+		}
+	}
+	return true
+}
+
+func (s *WsServer) disconnected(client *Client, err error) {
+	if len(s.disconnectHooks) == 0 {
+		return
+	}
+	info := DisconnectInfo{Code: websocket.CloseAbnormalClosure, Err: err}
+	var closeErr *websocket.CloseError
+	if code, reason, ok := client.closeSent(); ok {
+		info.Code, info.Reason = code, reason
+	} else if errors.As(err, &closeErr) {
+		info.Code, info.Reason = closeErr.Code, closeErr.Text
+	}
+	for _, hook := range s.disconnectHooks {
+		hook(client, info)
+	}
+}
+
+func (s *WsServer) reportError(client *Client, err error) {
+	for _, hook := range s.errorHooks {
+		hook(client, err)
+	}
+}
+
+// closing records the close frame sent by the server, only the first one is kept
+func (c *Client) closing(code int, reason string) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+}
+
+func (c *Client) closeSent() (code int, reason string, ok bool) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeCode, c.closeReason, c.closeCode != 0
+}
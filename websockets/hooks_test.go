@@ -0,0 +1,68 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	connects := make(chan string, 2)
+	disconnects := make(chan DisconnectInfo, 2)
+	errs := make(chan error, 1)
+	s := New("0").
+		OnConnect(func(client *Client, r *http.Request) error {
+			room := r.URL.Query().Get("room")
+			connects <- room
+			if room == "closed" {
+				return errors.New("room is closed")
+			}
+			return nil
+		}).
+		OnDisconnect(func(client *Client, info DisconnectInfo) { disconnects <- info }).
+		OnError(func(client *Client, err error) { errs <- err })
+	s.HandleFunc("fail", func(ctx context.Context, client *Client, msg *Envelope) error {
+		return errors.New("handler failed")
+	})
+	ts := newTestServer(t, s)
+
+	conn, _, err := ts.connect(ts.url+"/?room=lobby", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if room := <-connects; room != "lobby" {
+		t.Fatalf("OnConnect room = %q", room)
+	}
+
+	conn.WriteJSON(Envelope{Type: "fail"})
+	select {
+	case err := <-errs:
+		if err.Error() != "handler failed" {
+			t.Fatalf("OnError = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnError was not called")
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	if info := <-disconnects; info.Code != websocket.CloseNormalClosure || info.Reason != "bye" {
+		t.Fatalf("OnDisconnect = %+v", info)
+	}
+
+	// A failing connect hook closes the connection before any message is handled
+	rejected, _, err := ts.connect(ts.url+"/?room=closed", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	var closeErr *websocket.CloseError
+	if _, _, err := rejected.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseInternalServerErr {
+		t.Fatalf("ReadMessage error = %v", err)
+	}
+	if info := <-disconnects; info.Code != websocket.CloseInternalServerErr {
+		t.Fatalf("OnDisconnect = %+v", info)
+	}
+}
@@ -1,6 +1,7 @@
 package websockets
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -8,7 +9,14 @@ import (
 
 type SocketHandlerFunc func(w http.ResponseWriter, r *http.Request)
 
-type Handler func(conn *websocket.Conn, payload interface{})
+/*
+Handler handles the messages of one type.
+
+ctx is cancelled when the client disconnects or the server shuts down, and when the handler returns.
+It has a deadline with MessageTimeout or a Timeout middleware, and carries the message's TraceID and the
+values of the HTTP request the connection was upgraded from.
+*/
+type Handler func(ctx context.Context, client *Client, msg *Envelope) error
 
 type WebsocketServer interface {
 	New(port string) *WebsocketServer
@@ -18,7 +26,7 @@ type WebsocketServer interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	Insecure() *WebsocketServer
 	EnableAll() *WebsocketServer
-	UpgradeHTTPConntoWebSockets(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error)
+	UpgradeHTTPConntoWebSockets(w http.ResponseWriter, r *http.Request) (*Client, error)
 	RemoveClient(conn *websocket.Conn)
 	TerminateConnections()
 }
@@ -0,0 +1,316 @@
+package websockets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+const jsonRPCVersion = "2.0"
+
+// Standard JSON-RPC 2.0 error codes
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	// JSONRPCServerError is used for handler errors that have no standard code, the ErrorCode is sent in data
+	JSONRPCServerError = -32000
+)
+
+/*
+JSONRPCCodec speaks JSON-RPC 2.0 instead of the Envelope protocol.
+
+Methods are dispatched to the handlers registered for the message type of the same name, and params
+are the Payload. Handlers registered with HandleRequest or Handle reply with a JSON-RPC response,
+other handlers are answered with a null result once they return
+
+	-> {"jsonrpc": "2.0", "method": "order.create", "params": {"sku": "A1"}, "id": 17}
+	<- {"jsonrpc": "2.0", "result": {"order_id": "o-9"}, "id": 17}
+
+	-> {"jsonrpc": "2.0", "method": "order.create", "params": {}, "id": 18}
+	<- {"jsonrpc": "2.0", "error": {"code": -32602, "message": "sku is required", "data": {"code": "validation_failed"}}, "id": 18}
+
+Requests without an id are notifications and never answered, and batches are answered with an array.
+Every message the server sends on its own - Send, Publish, broadcasts - arrives as a notification
+with the message type as the method
+
+	<- {"jsonrpc": "2.0", "method": "publish", "params": {"price": 42}, "meta": {"topic": "prices.btc"}}
+
+Clients negotiate it with the "jsonrpc" subprotocol, or every connection can use it with JSONRPC().
+*/
+type JSONRPCCodec struct{}
+
+func (JSONRPCCodec) Name() string   { return "jsonrpc" }
+func (JSONRPCCodec) FrameType() int { return websocket.TextMessage }
+
+type jsonRPCMessage struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Method  string            `json:"method,omitempty"`
+	Params  json.RawMessage   `json:"params,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	ID      json.RawMessage   `json:"id,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// JSONRPCError is the error object of a JSON-RPC 2.0 response
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return e.Message
+}
+
+// clientFault reports whether the error is caused by the request, see ErrorCode.clientFault
+func (e *JSONRPCError) clientFault() bool {
+	switch e.Code {
+	case JSONRPCParseError, JSONRPCInvalidRequest, JSONRPCMethodNotFound, JSONRPCInvalidParams:
+		return true
+	case JSONRPCServerError:
+		data, ok := e.Data.(map[string]ErrorCode)
+		return ok && data["code"].clientFault()
+	}
+	return false
+}
+
+// Encode writes the Envelope as a notification
+func (JSONRPCCodec) Encode(env *Envelope) ([]byte, error) {
+	return json.Marshal(jsonRPCMessage{
+		JSONRPC: jsonRPCVersion,
+		Method:  env.Type,
+		Params:  env.Payload,
+		Meta:    env.Metadata,
+	})
+}
+
+// Decode reads a single request or notification, the id is kept as its raw JSON text
+func (JSONRPCCodec) Decode(data []byte, env *Envelope) error {
+	var msg jsonRPCMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	env.Type, env.Payload, env.Metadata = msg.Method, msg.Params, msg.Meta
+	env.ID = string(msg.ID)
+	return nil
+}
+
+func (JSONRPCCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONRPCCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return ErrEmptyPayload
+	}
+	return json.Unmarshal(data, v)
+}
+
+/*
+JSONRPC makes JSON-RPC 2.0 the protocol of every connection that does not negotiate another subprotocol.
+
+	wsServer := server.New("8080").JSONRPC().HandleRequest("sum", sumHandler)
+*/
+func (s *WsServer) JSONRPC() *WsServer {
+	s.Codecs(JSONRPCCodec{})
+	s.defaultCodec = JSONRPCCodec{}
+	return s
+}
+
+// serveJSONRPC answers a single JSON-RPC request or a batch
+func (s *WsServer) serveJSONRPC(client *Client, data []byte) {
+	data = bytes.TrimSpace(data)
+
+	var responses []*jsonRPCResponse
+	batch := false
+	if !client.limiter.allowFrame() {
+		err := s.rateLimitExceeded(client, "")
+		if err == nil {
+			s.clientError(client)
+			return
+		}
+		responses = append(responses, jsonRPCFailure(nil, toJSONRPCError(err)))
+	} else if len(data) > 0 && data[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(data, &raws); err != nil {
+			responses = append(responses, jsonRPCFailure(nil, &JSONRPCError{Code: JSONRPCParseError, Message: "parse error"}))
+		} else if len(raws) == 0 {
+			responses = append(responses, jsonRPCFailure(nil, &JSONRPCError{Code: JSONRPCInvalidRequest, Message: "invalid request"}))
+		} else {
+			batch = true
+			for _, raw := range raws {
+				if res := s.callJSONRPC(client, raw); res != nil {
+					responses = append(responses, res)
+				}
+			}
+		}
+	} else if res := s.callJSONRPC(client, data); res != nil {
+		responses = append(responses, res)
+	}
+
+	// A batch of notifications is not answered at all
+	if len(responses) == 0 {
+		return
+	}
+	var response interface{} = responses[0]
+	if batch {
+		response = responses
+	}
+	frame, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to encode JSON-RPC response: %v", err)
+		return
+	}
+	if err := client.enqueue(outbound{frameType: websocket.TextMessage, data: frame}); err != nil {
+		log.Printf("Failed to send JSON-RPC response: %v", err)
+		return
+	}
+
+	// Errors count toward MaxClientErrors once the client has been sent them
+	for _, res := range responses {
+		if res.Error != nil && res.Error.clientFault() {
+			s.clientError(client)
+		} else {
+			client.clientErrors = 0
+		}
+	}
+}
+
+// callJSONRPC dispatches one request, returning nil for notifications
+func (s *WsServer) callJSONRPC(client *Client, data []byte) *jsonRPCResponse {
+	var msg jsonRPCMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return jsonRPCFailure(nil, &JSONRPCError{Code: JSONRPCParseError, Message: "parse error"})
+		}
+		return jsonRPCFailure(nil, &JSONRPCError{Code: JSONRPCInvalidRequest, Message: "invalid request"})
+	}
+	if msg.JSONRPC != jsonRPCVersion || msg.Method == "" || !validJSONRPCID(msg.ID) {
+		return jsonRPCFailure(msg.ID, &JSONRPCError{Code: JSONRPCInvalidRequest, Message: "invalid request"})
+	}
+
+	notification := msg.ID == nil
+	if !client.limiter.allowType(msg.Method) {
+		if err := s.rateLimitExceeded(client, msg.Method); err != nil && !notification {
+			return jsonRPCFailure(msg.ID, toJSONRPCError(err))
+		}
+		return nil
+	}
+	if s.isDraining() {
+		if notification {
+			return nil
+		}
+		return jsonRPCFailure(msg.ID, toJSONRPCError(NewError(CodeUnavailable, ErrShuttingDown.Error())))
+	}
+	env := &Envelope{Type: msg.Method, ID: string(msg.ID), Payload: msg.Params, Metadata: msg.Meta}
+
+	ctx, cancel := s.messageContext(client, env)
+	defer cancel()
+
+	var (
+		result interface{}
+		err    error
+	)
+	if entry, middleware, exists := s.route(msg.Method); !exists {
+		err = &JSONRPCError{Code: JSONRPCMethodNotFound, Message: "method not found"}
+	} else if entry.request != nil {
+		// Request handlers return their result as the response instead of sending a reply frame
+		err = chain(func(ctx context.Context, client *Client, req *Envelope) error {
+			result, err = s.runRequest(ctx, client, req, entry.request)
+			return err
+		}, middleware)(ctx, client, env)
+		if errors.Is(err, errClientGone) {
+			return nil
+		}
+	} else {
+		err = chain(entry.handler, middleware)(ctx, client, env)
+	}
+
+	if notification {
+		if err != nil {
+			log.Printf("JSON-RPC notification %q failed: %v", msg.Method, err)
+		}
+		return nil
+	}
+	if err != nil {
+		log.Printf("JSON-RPC method %q failed: %v", msg.Method, err)
+		return jsonRPCFailure(msg.ID, toJSONRPCError(err))
+	}
+
+	res := &jsonRPCResponse{JSONRPC: jsonRPCVersion, ID: msg.ID, Result: json.RawMessage("null")}
+	if _, noReply := result.(NoReply); result != nil && !noReply {
+		payload, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Failed to marshal the %q response: %v", msg.Method, err)
+			return jsonRPCFailure(msg.ID, &JSONRPCError{Code: JSONRPCInternalError, Message: errInternal.Message})
+		}
+		res.Result = payload
+	}
+	return res
+}
+
+// validJSONRPCID reports whether the id is absent, null, a string or a number
+func validJSONRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	var value interface{}
+	if err := json.Unmarshal(id, &value); err != nil {
+		return false
+	}
+	switch value.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+func jsonRPCFailure(id json.RawMessage, err *JSONRPCError) *jsonRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonRPCResponse{JSONRPC: jsonRPCVersion, Error: err, ID: id}
+}
+
+// toJSONRPCError maps handler errors to the standard codes, keeping the ErrorCode in data
+func toJSONRPCError(err error) *JSONRPCError {
+	var rpcErr *JSONRPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	var wsErr *Error
+	if !errors.As(err, &wsErr) {
+		// The message of other errors may hold server internals
+		return &JSONRPCError{Code: JSONRPCInternalError, Message: errInternal.Message}
+	}
+
+	code := JSONRPCServerError
+	switch wsErr.Code {
+	case CodeBadRequest:
+		code = JSONRPCInvalidRequest
+	case CodeInvalidPayload, CodeValidationFailed:
+		code = JSONRPCInvalidParams
+	case CodeInternal:
+		code = JSONRPCInternalError
+	}
+	return &JSONRPCError{
+		Code:    code,
+		Message: wsErr.Message,
+		Data:    map[string]ErrorCode{"code": wsErr.Code},
+	}
+}
@@ -0,0 +1,87 @@
+package websockets
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestJSONRPC(t *testing.T) {
+	s := New("0").JSONRPC()
+	Handle(s, "join", func(ctx context.Context, client *Client, req joinRequest) (joinResponse, error) {
+		if err := client.Send("joined", req.Room); err != nil {
+			return joinResponse{}, err
+		}
+		return joinResponse{Room: req.Room, Members: 1}, nil
+	})
+	conn := dialTestServer(t, s)
+
+	read := func() string {
+		t.Helper()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		return string(data)
+	}
+
+	conn.WriteMessage(1, []byte(`{"jsonrpc":"2.0","method":"join","params":{"room":"lobby"},"id":1}`))
+	if got, want := read(), `{"jsonrpc":"2.0","method":"joined","params":"lobby"}`; got != want {
+		t.Fatalf("notification = %s, want %s", got, want)
+	}
+	if got, want := read(), `{"jsonrpc":"2.0","result":{"room":"lobby","members":1},"id":1}`; got != want {
+		t.Fatalf("response = %s, want %s", got, want)
+	}
+
+	conn.WriteMessage(1, []byte(`{"jsonrpc":"2.0","method":"join"`))
+	if got, want := read(), `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`; got != want {
+		t.Fatalf("parse error = %s, want %s", got, want)
+	}
+
+	// Notifications in a batch are not answered
+	conn.WriteMessage(1, []byte(`[
+		{"jsonrpc":"2.0","method":"missing","id":"a"},
+		{"jsonrpc":"2.0","method":"missing"},
+		{"jsonrpc":"2.0","method":"join","params":{},"id":"b"},
+		{"jsonrpc":"1.0","method":"join","id":"c"}
+	]`))
+	want := `[{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found"},"id":"a"},` +
+		`{"jsonrpc":"2.0","error":{"code":-32602,"message":"room is required","data":{"code":"validation_failed"}},"id":"b"},` +
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":"c"}]`
+	if got := read(); got != want {
+		t.Fatalf("batch = %s, want %s", got, want)
+	}
+}
+
+func TestJSONRPCDuringShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := New("0").JSONRPC()
+	s.HandleFunc("slow", func(ctx context.Context, client *Client, msg *Envelope) error {
+		<-release
+		return nil
+	})
+	ts := newTestServer(t, s)
+	busy, conn := ts.dial(""), ts.dial("")
+
+	busy.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"slow","id":1}`))
+	for atomic.LoadInt64(&s.handlersInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go s.Shutdown(ctx, "maintenance")
+	for !s.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	defer close(release)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"slow","id":2}`))
+	_, data, err := conn.ReadMessage()
+	want := `{"jsonrpc":"2.0","error":{"code":-32000,"message":"server is shutting down","data":{"code":"unavailable"}},"id":2}`
+	if err != nil || string(data) != want {
+		t.Fatalf("response = %s, %v, want %s", data, err, want)
+	}
+}
@@ -0,0 +1,153 @@
+package websockets
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+Stats is a snapshot of the server counters.
+*/
+type Stats struct {
+	ActiveConnections int                         `json:"active_connections"`
+	TotalConnections  int64                       `json:"total_connections"`
+	MessagesSent      int64                       `json:"messages_sent"`
+	MessagesReceived  int64                       `json:"messages_received"`
+	MessagesDropped   int64                       `json:"messages_dropped"`
+	BytesSent         int64                       `json:"bytes_sent"`
+	BytesReceived     int64                       `json:"bytes_received"`
+	SlowConsumers     int64                       `json:"slow_consumers"`
+	HeartbeatTimeouts int64                       `json:"heartbeat_timeouts"`
+	IdleTimeouts      int64                       `json:"idle_timeouts"`
+	AuthRejections    int64                       `json:"auth_rejections"`
+	OriginRejections  int64                       `json:"origin_rejections"`
+	UpgradeFailures   int64                       `json:"upgrade_failures"`
+	AdmissionRejects  int64                       `json:"admission_rejects"`
+	RateLimited       int64                       `json:"rate_limited"`
+	OversizedMessages int64                       `json:"oversized_messages"`
+	ClientErrors      int64                       `json:"client_errors"`
+	MessageTypes      map[string]MessageTypeStats `json:"message_types"`
+}
+
+/*
+Stats returns a snapshot of the server counters.
+*/
+func (s *WsServer) Stats() Stats {
+	s.activeClientsMu.RLock()
+	active := len(s.activeClients)
+	s.activeClientsMu.RUnlock()
+
+	c := &s.counter
+	return Stats{
+		ActiveConnections: active,
+		TotalConnections:  atomic.LoadInt64(&c.totalConnections),
+		MessagesSent:      atomic.LoadInt64(&c.totalMessagesSent),
+		MessagesReceived:  atomic.LoadInt64(&c.totalMessagesReceived),
+		MessagesDropped:   atomic.LoadInt64(&c.totalMessagesDropped),
+		BytesSent:         atomic.LoadInt64(&c.bytesSent),
+		BytesReceived:     atomic.LoadInt64(&c.bytesReceived),
+		SlowConsumers:     atomic.LoadInt64(&c.totalSlowConsumers),
+		HeartbeatTimeouts: atomic.LoadInt64(&c.totalHeartbeatTimeout),
+		IdleTimeouts:      atomic.LoadInt64(&c.totalIdleTimeouts),
+		AuthRejections:    atomic.LoadInt64(&c.totalAuthRejections),
+		OriginRejections:  atomic.LoadInt64(&c.totalOriginRejections),
+		UpgradeFailures:   atomic.LoadInt64(&c.totalUpgradeFailures),
+		AdmissionRejects:  atomic.LoadInt64(&c.totalAdmissionRejects),
+		RateLimited:       atomic.LoadInt64(&c.totalRateLimited),
+		OversizedMessages: atomic.LoadInt64(&c.totalOversized),
+		ClientErrors:      atomic.LoadInt64(&c.totalClientErrors),
+		MessageTypes:      c.MessageTypes(),
+	}
+}
+
+/*
+EnableMetrics serves the server stats in the Prometheus text format on the path, and installs the Metrics
+middleware so per message type counters and latency histograms are recorded.
+
+	wsServer := server.New("8080").EnableAll().EnableMetrics("/metrics")
+
+	// prometheus.yml
+	scrape_configs:
+	  - job_name: websockets
+	    static_configs:
+	      - targets: ["localhost:8080"]
+
+Use MetricsHandler instead to serve the metrics from another HTTP server.
+*/
+func (s *WsServer) EnableMetrics(path string) *WsServer {
+	s.serveHTTPPath(path, s.MetricsHandler())
+	return s.Use(Metrics())
+}
+
+/*
+MetricsHandler returns an http.Handler writing the server stats in the Prometheus text format.
+*/
+func (s *WsServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, s.Stats())
+	})
+}
+
+func writeMetrics(w io.Writer, stats Stats) {
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+
+	metric("websocket_active_connections", "gauge", "Number of open websocket connections.", int64(stats.ActiveConnections))
+	metric("websocket_connections_total", "counter", "Websocket connections accepted.", stats.TotalConnections)
+	metric("websocket_upgrade_failures_total", "counter", "HTTP requests that failed to upgrade to a websocket.", stats.UpgradeFailures)
+	metric("websocket_admission_rejections_total", "counter", "Upgrades rejected by an admission limit.", stats.AdmissionRejects)
+	metric("websocket_auth_rejections_total", "counter", "Upgrades rejected by the Authenticator.", stats.AuthRejections)
+	metric("websocket_origin_rejections_total", "counter", "Upgrades rejected by the origin policy.", stats.OriginRejections)
+	metric("websocket_messages_received_total", "counter", "Messages read from clients.", stats.MessagesReceived)
+	metric("websocket_messages_sent_total", "counter", "Messages written to clients.", stats.MessagesSent)
+	metric("websocket_messages_dropped_total", "counter", "Messages dropped because a send queue was full.", stats.MessagesDropped)
+	metric("websocket_received_bytes_total", "counter", "Bytes read from clients.", stats.BytesReceived)
+	metric("websocket_sent_bytes_total", "counter", "Bytes written to clients.", stats.BytesSent)
+	metric("websocket_slow_consumers_total", "counter", "Clients disconnected as slow consumers.", stats.SlowConsumers)
+	metric("websocket_heartbeat_timeouts_total", "counter", "Clients disconnected after missing a heartbeat.", stats.HeartbeatTimeouts)
+	metric("websocket_idle_timeouts_total", "counter", "Clients disconnected after being idle.", stats.IdleTimeouts)
+	metric("websocket_rate_limited_total", "counter", "Messages over a rate limit.", stats.RateLimited)
+	metric("websocket_client_errors_total", "counter", "Messages rejected because of a client error.", stats.ClientErrors)
+	metric("websocket_oversized_messages_total", "counter", "Messages over the read limit.", stats.OversizedMessages)
+
+	msgTypes := make([]string, 0, len(stats.MessageTypes))
+	for msgType := range stats.MessageTypes {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Strings(msgTypes)
+
+	fmt.Fprintf(w, "# HELP websocket_handled_messages_total Messages handled per type.\n# TYPE websocket_handled_messages_total counter\n")
+	for _, msgType := range msgTypes {
+		fmt.Fprintf(w, "websocket_handled_messages_total{type=%s} %d\n", labelValue(msgType), stats.MessageTypes[msgType].Count)
+	}
+	fmt.Fprintf(w, "# HELP websocket_handler_errors_total Handler errors per type.\n# TYPE websocket_handler_errors_total counter\n")
+	for _, msgType := range msgTypes {
+		fmt.Fprintf(w, "websocket_handler_errors_total{type=%s} %d\n", labelValue(msgType), stats.MessageTypes[msgType].Errors)
+	}
+
+	fmt.Fprintf(w, "# HELP websocket_handler_duration_seconds Handler latency per type.\n# TYPE websocket_handler_duration_seconds histogram\n")
+	for _, msgType := range msgTypes {
+		typeStats, label := stats.MessageTypes[msgType], labelValue(msgType)
+		var cumulative int64
+		for i, bound := range LatencyBuckets {
+			cumulative += typeStats.Buckets[i]
+			fmt.Fprintf(w, "websocket_handler_duration_seconds_bucket{type=%s,le=\"%g\"} %d\n", label, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(w, "websocket_handler_duration_seconds_bucket{type=%s,le=\"+Inf\"} %d\n", label, typeStats.Count)
+		fmt.Fprintf(w, "websocket_handler_duration_seconds_sum{type=%s} %g\n", label, typeStats.TotalLatency.Seconds())
+		fmt.Fprintf(w, "websocket_handler_duration_seconds_count{type=%s} %d\n", label, typeStats.Count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value as required by the text format
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,79 @@
+package websockets
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := New("0").EnableAll().EnableMetrics("/metrics")
+	ts := newTestServer(t, s)
+
+	conn := ts.dial("")
+	conn.WriteJSON(Envelope{Type: "healthcheck"})
+	conn.ReadJSON(&Envelope{})
+
+	// A plain HTTP request to the websocket endpoint fails to upgrade
+	if resp, err := http.Get(ts.httpURL + "/"); err == nil {
+		resp.Body.Close()
+	}
+
+	var body string
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(ts.httpURL + "/metrics")
+		if err != nil {
+			t.Fatalf("GET /metrics: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(data)
+		if strings.Contains(body, `websocket_handled_messages_total{type="healthcheck"} 1`) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, want := range []string{
+		"websocket_active_connections 1",
+		"websocket_upgrade_failures_total 1",
+		"websocket_messages_received_total 1",
+		`websocket_handled_messages_total{type="healthcheck"} 1`,
+		`websocket_handler_duration_seconds_bucket{type="healthcheck",le="+Inf"} 1`,
+		`websocket_handler_duration_seconds_count{type="healthcheck"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestEnableMetricsWhileServing(t *testing.T) {
+	s := New("0").EnableAll()
+	ts := newTestServer(t, s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if resp, err := http.Get(ts.httpURL + "/metrics"); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	s.EnableMetrics("/metrics")
+	s.EnableAdmin("/admin", userAuthenticator())
+	<-done
+
+	resp, err := http.Get(ts.httpURL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics = %d after EnableMetrics", resp.StatusCode)
+	}
+}
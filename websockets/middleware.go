@@ -0,0 +1,169 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+/*
+Middleware wraps a Handler, for example to log, authorize or time every message.
+
+	func RequireUser(next websockets.Handler) websockets.Handler {
+		return func(ctx context.Context, client *websockets.Client, msg *websockets.Envelope) error {
+			if client.Principal == nil {
+				return websockets.NewError(websockets.CodeUnauthorized, "login required")
+			}
+			return next(ctx, client, msg)
+		}
+	}
+*/
+type Middleware func(next Handler) Handler
+
+/*
+Use adds middleware that wraps every Handler, including handlers registered before the call.
+
+Middleware runs in the order it is added, before the middleware passed to HandleFunc.
+New installs Recovery as the outermost middleware so a panicking handler never takes the connection down.
+
+	wsServer := server.New("8080").EnableAll().Use(
+		websockets.Logging(slog.Default()),
+		websockets.Metrics(),
+		websockets.Timeout(10*time.Second),
+	)
+*/
+func (s *WsServer) Use(middleware ...Middleware) *WsServer {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+	return s
+}
+
+// chain wraps the handler so middleware[0] runs first
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+/*
+Recovery turns a panic in a Handler into a CodeInternal error and logs the stack trace.
+*/
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, client *Client, msg *Envelope) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Handler for %q panicked: %v\n%s", msg.Type, r, debug.Stack())
+					err = NewError(CodeInternal, "internal error")
+				}
+			}()
+			return next(ctx, client, msg)
+		}
+	}
+}
+
+/*
+Logging logs every message with its type, id, trace id, user, duration and error. A nil logger uses slog.Default().
+*/
+func Logging(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, client *Client, msg *Envelope) error {
+			start := time.Now()
+			err := next(ctx, client, msg)
+
+			l := logger
+			if l == nil {
+				l = slog.Default()
+			}
+			attrs := []slog.Attr{
+				slog.String("type", msg.Type),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if msg.ID != "" {
+				attrs = append(attrs, slog.String("id", msg.ID))
+			}
+			if traceID := TraceID(ctx); traceID != "" {
+				attrs = append(attrs, slog.String("trace_id", traceID))
+			}
+			if client.Principal != nil {
+				attrs = append(attrs, slog.String("user", client.Principal.UserID))
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+				l.LogAttrs(ctx, slog.LevelError, "websocket message failed", attrs...)
+			} else {
+				l.LogAttrs(ctx, slog.LevelInfo, "websocket message", attrs...)
+			}
+			return err
+		}
+	}
+}
+
+/*
+Metrics counts messages, errors and handler latency per message type. The results are
+available from WsServer.MessageStats and are included in PrintStats.
+
+Panics unwind past Metrics to Recovery and are not counted, nor are messages whose client disconnected before
+they completed.
+*/
+func Metrics() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, client *Client, msg *Envelope) error {
+			start := time.Now()
+			err := next(ctx, client, msg)
+			failed := err
+			if errors.Is(err, errClientGone) {
+				failed = nil
+			}
+			client.server.counter.ObserveMessage(msg.Type, time.Since(start), failed)
+			return err
+		}
+	}
+}
+
+/*
+Timeout cancels the Handler's ctx after the timeout and returns a CodeTimeout error without waiting for it.
+
+Handlers should watch ctx to stop work early, a handler that ignores it keeps running in the background and
+Shutdown waits for it. When the client disconnects first nothing is sent or reported.
+*/
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, client *Client, msg *Envelope) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			done := make(chan error, 1)
+			panics := make(chan interface{}, 1)
+			abandon := client.server.detach(func() {
+				defer func() {
+					if r := recover(); r != nil {
+						panics <- r
+					}
+				}()
+				done <- next(ctx, client, msg)
+			})
+
+			select {
+			case err := <-done:
+				return err
+			case r := <-panics:
+				// Re-raised so an outer Recovery reports it
+				panic(r)
+			case <-ctx.Done():
+				abandon()
+				if client.Context().Err() != nil {
+					// The client is gone, the read loop does not reply or report it
+					return errClientGone
+				}
+				return NewError(CodeTimeout, fmt.Sprintf("%s timed out after %s", msg.Type, timeout))
+			}
+		}
+	}
+}
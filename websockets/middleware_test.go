@@ -0,0 +1,100 @@
+package websockets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, client *Client, msg *Envelope) error {
+				calls = append(calls, name)
+				return next(ctx, client, msg)
+			}
+		}
+	}
+
+	s := New("0")
+	s.HandleFunc("ping", func(ctx context.Context, client *Client, msg *Envelope) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("route"))
+	// Middleware added after registration still applies
+	s.Use(trace("first"), trace("second"))
+
+	handler, _ := s.handler("ping")
+	if err := handler(context.Background(), &Client{}, &Envelope{Type: "ping"}); err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	if got := strings.Join(calls, ","); got != "first,second,route,handler" {
+		t.Fatalf("calls = %s", got)
+	}
+}
+
+func TestMiddlewareRecoveryAndTimeout(t *testing.T) {
+	s := New("0").Use(Metrics(), Timeout(20*time.Millisecond))
+	s.HandleFunc("panic", func(ctx context.Context, client *Client, msg *Envelope) error {
+		panic("boom")
+	})
+	s.HandleFunc("slow", func(ctx context.Context, client *Client, msg *Envelope) error {
+		<-ctx.Done()
+		return nil
+	})
+	conn := dialTestServer(t, s)
+
+	for _, msgType := range []string{"panic", "slow", "panic"} {
+		if err := conn.WriteJSON(Envelope{Type: msgType}); err != nil {
+			t.Fatalf("WriteJSON: %v", err)
+		}
+	}
+	// The connection survives the panic and keeps serving messages
+	s.HealthCheckHandler(context.Background(), s.clients()[0], nil)
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "healthcheck" {
+		t.Fatalf("ReadJSON = %+v, %v", env, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := s.MessageStats()
+		if stats["slow"].Errors == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTimeoutClientGone(t *testing.T) {
+	started := make(chan struct{})
+	errs := make(chan error, 4)
+	disconnected := make(chan struct{})
+	s := New("0").Use(Metrics(), Timeout(time.Minute)).
+		OnError(func(client *Client, err error) { errs <- err }).
+		OnDisconnect(func(client *Client, info DisconnectInfo) { close(disconnected) })
+	s.HandleFunc("wait", func(ctx context.Context, client *Client, msg *Envelope) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	})
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "wait"})
+	<-started
+	conn.Close()
+	<-disconnected
+	select {
+	case err := <-errs:
+		t.Fatalf("OnError = %v, want no error for a message whose client is gone", err)
+	default:
+	}
+	if stats := s.MessageStats(); stats["wait"].Errors != 0 {
+		t.Fatalf("stats = %+v, want no errors", stats["wait"])
+	}
+}
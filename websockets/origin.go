@@ -0,0 +1,169 @@
+package websockets
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+OriginPolicy decides which browser origins may open a websocket connection.
+
+Origins entries can be
+
+  - an exact host - "app.example.com" or "localhost:3000"
+  - a wildcard subdomain - "*.example.com" matches "app.example.com" and "eu.app.example.com" but not "example.com"
+  - either of the above with a scheme - "https://*.example.com" - which only allows that scheme
+
+Entries without a port match the host on any port. Schemes restricts the scheme of every entry without one,
+defaulting to https only.
+Same-origin requests are always allowed, as with the default gorilla check.
+*/
+type OriginPolicy struct {
+	Origins []string
+	Schemes []string
+	// AllowNoOrigin accepts requests without an Origin header, which are sent by non-browser clients
+	AllowNoOrigin bool
+}
+
+/*
+Allowed reports whether the Origin header value is allowed by the policy.
+*/
+func (p OriginPolicy) Allowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+
+	for _, entry := range p.Origins {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		schemes := p.Schemes
+		if len(schemes) == 0 {
+			schemes = []string{"https"}
+		}
+		if entryScheme, entryHost, found := strings.Cut(entry, "://"); found {
+			schemes, entry = []string{entryScheme}, entryHost
+		}
+
+		if !containsFold(schemes, scheme) {
+			continue
+		}
+		if hostMatches(entry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches compares the host of an origin with an entry, entries without a port match any port
+func hostMatches(pattern, host string) bool {
+	if _, _, err := net.SplitHostPort(pattern); err != nil {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		pattern = strings.Trim(pattern, "[]")
+	}
+	if suffix, wildcard := strings.CutPrefix(pattern, "*."); wildcard {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+OriginPolicyFromEnv builds an OriginPolicy from environment variables so each environment can ship its own allowlist.
+
+  - <prefix>ALLOWED_ORIGINS - comma separated Origins
+  - <prefix>ALLOWED_ORIGIN_SCHEMES - comma separated Schemes
+  - <prefix>ALLOW_NO_ORIGIN - true to accept requests without an Origin header
+
+Example
+
+	// WS_ALLOWED_ORIGINS="*.example.com,admin.example.org"
+	wsServer := server.New("8080").EnableAll().Origins(websockets.OriginPolicyFromEnv("WS_"))
+*/
+func OriginPolicyFromEnv(prefix string) OriginPolicy {
+	allowNoOrigin, _ := strconv.ParseBool(os.Getenv(prefix + "ALLOW_NO_ORIGIN"))
+	return OriginPolicy{
+		Origins:       splitList(os.Getenv(prefix + "ALLOWED_ORIGINS")),
+		Schemes:       splitList(os.Getenv(prefix + "ALLOWED_ORIGIN_SCHEMES")),
+		AllowNoOrigin: allowNoOrigin,
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+Origins only accepts connections from origins allowed by the policy. Rejected origins are logged and counted.
+
+This replaces Insecure() for production deployments.
+
+	wsServer := server.New("8080").EnableAll().Origins(websockets.OriginPolicy{
+		Origins: []string{"*.example.com", "http://localhost:3000"},
+	})
+*/
+func (s *WsServer) Origins(policy OriginPolicy) *WsServer {
+	s.Upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		switch {
+		case origin == "":
+			if policy.AllowNoOrigin {
+				return true
+			}
+		case sameOrigin(origin, r.Host), policy.Allowed(origin):
+			return true
+		}
+
+		log.Printf("Rejected connection from %s with origin %q", r.RemoteAddr, origin)
+		s.counter.IncrementOriginRejections()
+		return false
+	}
+	return s
+}
+
+// errOriginRejected is returned for upgrades from an origin the Upgrader does not accept
+var errOriginRejected = errors.New("origin not allowed")
+
+// rejectOrigin answers upgrades from origins the Upgrader does not accept, before they are authenticated or admitted
+func (s *WsServer) rejectOrigin(w http.ResponseWriter, r *http.Request) error {
+	checkOrigin := s.Upgrader.CheckOrigin
+	if checkOrigin == nil {
+		// The default check of the Upgrader
+		checkOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || sameOrigin(origin, r.Host)
+		}
+	}
+	if checkOrigin(r) {
+		return nil
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return errOriginRejected
+}
+
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
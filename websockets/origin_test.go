@@ -0,0 +1,62 @@
+package websockets
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOriginPolicyAllowed(t *testing.T) {
+	policy := OriginPolicy{
+		Origins: []string{"app.example.com", "*.example.org", "http://localhost:3000"},
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://app.example.com:8443", true},
+		{"https://eu.app.example.org", true},
+		{"https://example.org", false},
+		{"https://notexample.org", false},
+		{"http://localhost:3000", true},
+		{"https://localhost:3000", false},
+		{"http://localhost:4000", false},
+		{"https://eu.example.org:8443", true},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Allowed(tt.origin); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestOriginRejectedBeforeAuthentication(t *testing.T) {
+	var authenticated int32
+	s := New("0").EnableAll().
+		Origins(OriginPolicy{Origins: []string{"*.example.com"}}).
+		Authenticate(AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+			atomic.AddInt32(&authenticated, 1)
+			return &Principal{UserID: "u1"}, nil
+		}))
+	ts := newTestServer(t, s)
+
+	_, resp, err := ts.connect(ts.url, http.Header{"Origin": {"https://evil.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Dial from a rejected origin = %v, %v, want 403", resp, err)
+	}
+	if got := atomic.LoadInt32(&authenticated); got != 0 {
+		t.Fatalf("rejected origin was authenticated %d times", got)
+	}
+	if got := s.Stats().OriginRejections; got != 1 {
+		t.Fatalf("OriginRejections = %d, want 1", got)
+	}
+
+	if _, _, err := ts.connect(ts.url, http.Header{"Origin": {"https://app.example.com:8443"}}); err != nil {
+		t.Fatalf("Dial from an allowed origin: %v", err)
+	}
+}
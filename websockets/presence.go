@@ -0,0 +1,181 @@
+package websockets
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// PresenceTopic is the topic server wide join and leave events are sent to
+const PresenceTopic = "presence"
+
+// PresenceEntry is an online user and the number of connections it has open
+type PresenceEntry struct {
+	UserID      string `json:"user_id" msgpack:"user_id"`
+	Connections int    `json:"connections" msgpack:"connections"`
+}
+
+/*
+EnablePresence tracks which authenticated users are online, across the server and per room.
+
+A room is a topic without wildcards, a user is in the room while one of its connections is subscribed to it.
+Users are counted once however many connections they have open, so closing one tab does not make them leave.
+Clients without a Principal are not tracked.
+
+Subscribers of the room receive join and leave events, and subscribers of the "presence" topic receive them
+for the whole server
+
+	{"type": "presence.join", "metadata": {"topic": "chat.lobby"}, "payload": {"user_id": "u1", "connections": 1}}
+	{"type": "presence.leave", "metadata": {"topic": "presence"}, "payload": {"user_id": "u1", "connections": 0}}
+
+The presence.list request returns the users in a room, or on the server without a topic
+
+	{"type": "presence.list", "id": "1", "metadata": {"topic": "chat.lobby"}}
+	{"type": "presence.list", "id": "1", "payload": [{"user_id": "u1", "connections": 2}]}
+
+Presence is tracked per server instance.
+*/
+func (s *WsServer) EnablePresence() *WsServer {
+	s.presence = &presence{rooms: make(map[string]map[string]int)}
+	s.HandleRequest("presence.list", s.PresenceListHandler)
+	return s
+}
+
+// presence counts the connections of each user per room, the server wide room is ""
+type presence struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]int
+}
+
+/*
+Presence returns the users in the room, or on the server when room is empty, sorted by UserID.
+*/
+func (s *WsServer) Presence(room string) []PresenceEntry {
+	if s.presence == nil {
+		return nil
+	}
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	users := s.presence.rooms[room]
+	entries := make([]PresenceEntry, 0, len(users))
+	for userID, connections := range users {
+		entries = append(entries, PresenceEntry{UserID: userID, Connections: connections})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UserID < entries[j].UserID })
+	return entries
+}
+
+/*
+Online reports whether the user has a connection open to the server.
+*/
+func (s *WsServer) Online(userID string) bool {
+	if s.presence == nil {
+		return false
+	}
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+	return s.presence.rooms[""][userID] > 0
+}
+
+/*
+PresenceListHandler replies with the users in the room named by the topic metadata, see EnablePresence.
+*/
+func (s *WsServer) PresenceListHandler(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+	room := msg.Metadata[topicMetadataKey]
+	if room != "" && !isPresenceRoom(room) {
+		return nil, NewError(CodeInvalidTopic, "presence rooms are topics without wildcards")
+	}
+	return s.Presence(room), nil
+}
+
+func isPresenceRoom(topic string) bool {
+	return topic != PresenceTopic && validateTopic(topic, false) == nil
+}
+
+// presenceJoin counts a connection of the Client's user in the room, announcing the user when it is the first one
+func (s *WsServer) presenceJoin(room string, client *Client) {
+	if s.presence == nil || client.Principal == nil || (room != "" && !isPresenceRoom(room)) {
+		return
+	}
+	p := s.presence
+	p.mu.Lock()
+	users, ok := p.rooms[room]
+	if !ok {
+		users = make(map[string]int)
+		p.rooms[room] = users
+	}
+	userID := client.Principal.UserID
+	users[userID]++
+	var event *presenceEvent
+	if users[userID] == 1 {
+		event = s.newPresenceEvent("presence.join", room, PresenceEntry{UserID: userID, Connections: users[userID]})
+	}
+	p.mu.Unlock()
+
+	event.send()
+}
+
+// presenceLeave removes a connection of the Client's user from the room, announcing the user leaving with the last one
+func (s *WsServer) presenceLeave(room string, client *Client) {
+	if s.presence == nil || client.Principal == nil || (room != "" && !isPresenceRoom(room)) {
+		return
+	}
+	p := s.presence
+	p.mu.Lock()
+	users, ok := p.rooms[room]
+	userID := client.Principal.UserID
+	if !ok || users[userID] == 0 {
+		p.mu.Unlock()
+		return
+	}
+	var event *presenceEvent
+	if users[userID]--; users[userID] == 0 {
+		delete(users, userID)
+		if len(users) == 0 {
+			delete(p.rooms, room)
+		}
+		event = s.newPresenceEvent("presence.leave", room, PresenceEntry{UserID: userID})
+	}
+	p.mu.Unlock()
+
+	event.send()
+}
+
+// presenceEvent is a join or leave event and the subscribers of the room it is sent to
+type presenceEvent struct {
+	msgType     string
+	topic       string
+	entry       PresenceEntry
+	subscribers []*Client
+}
+
+// newPresenceEvent collects the subscribers of the room with the presence lock held, the event is sent once it
+// is released so a slow subscriber never stalls connections joining or leaving
+func (s *WsServer) newPresenceEvent(msgType, room string, entry PresenceEntry) *presenceEvent {
+	topic := room
+	if topic == "" {
+		topic = PresenceTopic
+	}
+	return &presenceEvent{msgType: msgType, topic: topic, entry: entry, subscribers: s.subscribers(topic)}
+}
+
+func (e *presenceEvent) send() {
+	if e == nil {
+		return
+	}
+	for _, client := range e.subscribers {
+		payload, err := client.Codec.Marshal(e.entry)
+		if err == nil {
+			err = client.WriteEnvelope(&Envelope{
+				Type:     e.msgType,
+				Payload:  payload,
+				Metadata: map[string]string{topicMetadataKey: e.topic},
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to send %s to a client: %v", e.msgType, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package websockets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPresence(t *testing.T) {
+	s := New("0").EnableAll().EnablePresence().Authenticate(userAuthenticator())
+	dial := newTestServer(t, s).dial
+	expect := func(conn *websocket.Conn, msgType, topic, payload string) {
+		t.Helper()
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		if env.Type != msgType || env.Metadata["topic"] != topic || string(env.Payload) != payload {
+			t.Fatalf("got %s %v %s, want %s %s %s", env.Type, env.Metadata, env.Payload, msgType, topic, payload)
+		}
+	}
+
+	watcher := dial("watcher")
+	watcher.WriteJSON(Envelope{Type: "subscribe", Metadata: map[string]string{"topic": "presence"}})
+	expect(watcher, "subscribe", "presence", "")
+	watcher.WriteJSON(Envelope{Type: "subscribe", Metadata: map[string]string{"topic": "chat.*"}})
+	expect(watcher, "subscribe", "chat.*", "")
+
+	tab1 := dial("u1")
+	expect(watcher, "presence.join", "presence", `{"user_id":"u1","connections":1}`)
+	tab2 := dial("u1")
+	tab2.WriteJSON(Envelope{Type: "subscribe", Metadata: map[string]string{"topic": "chat.lobby"}})
+	// The subscriber is in the room, so it receives its own join before the acknowledgement
+	expect(tab2, "presence.join", "chat.lobby", `{"user_id":"u1","connections":1}`)
+	expect(tab2, "subscribe", "chat.lobby", "")
+	expect(watcher, "presence.join", "chat.lobby", `{"user_id":"u1","connections":1}`)
+
+	watcher.WriteJSON(Envelope{Type: "presence.list", ID: "1"})
+	expect(watcher, "presence.list", "", `[{"user_id":"u1","connections":2},{"user_id":"watcher","connections":1}]`)
+
+	// Closing one of the two tabs keeps the user online
+	tab2.Close()
+	expect(watcher, "presence.leave", "chat.lobby", `{"user_id":"u1","connections":0}`)
+	if !s.Online("u1") {
+		t.Fatalf("u1 went offline with a tab open")
+	}
+	tab1.Close()
+	expect(watcher, "presence.leave", "presence", `{"user_id":"u1","connections":0}`)
+	if s.Online("u1") || len(s.Presence("chat.lobby")) != 0 {
+		t.Fatalf("u1 still present: %v", s.Presence(""))
+	}
+}
+
+func TestPresenceSlowSubscriber(t *testing.T) {
+	s := New("0").EnableAll().EnablePresence().Authenticate(userAuthenticator()).
+		SendQueue(SendQueueConfig{Size: 1, Policy: BlockWithTimeout, BlockTimeout: 2 * time.Second})
+	stalled, release := make(chan *Client), make(chan struct{})
+	defer close(release)
+	s.HandleFunc("stall", func(ctx context.Context, client *Client, msg *Envelope) error {
+		// Holding the write lock stalls the writer goroutine, so the queue fills up
+		client.Mu.Lock()
+		defer client.Mu.Unlock()
+		stalled <- client
+		<-release
+		return nil
+	})
+	ts := newTestServer(t, s)
+
+	watcher := ts.dial("watcher")
+	watcher.WriteJSON(Envelope{Type: "subscribe", Metadata: map[string]string{"topic": "presence"}})
+	watcher.ReadJSON(&Envelope{})
+	watcher.WriteJSON(Envelope{Type: "stall"})
+	slow := <-stalled
+
+	// The writer holds the first join, the second fills the queue and the third waits for room
+	for _, user := range []string{"u1", "u2", "u3"} {
+		ts.dial(user)
+	}
+	for len(slow.send) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	s.Presence("")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Presence waited %s for the join sent to a slow subscriber", elapsed)
+	}
+}
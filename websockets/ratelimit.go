@@ -0,0 +1,251 @@
+package websockets
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+RateLimit is a token bucket allowing Rate messages per second on average, with bursts of up to Burst messages.
+
+The zero value does not limit.
+*/
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+/*
+RateLimitPolicy decides what happens to a message that exceeds a RateLimit.
+*/
+type RateLimitPolicy int
+
+const (
+	// DropMessage silently discards the message
+	DropMessage RateLimitPolicy = iota
+	// ReplyRateLimited discards the message and replies with a CodeRateLimited error frame
+	ReplyRateLimited
+	// ClosePolicyViolation closes the connection with websocket.ClosePolicyViolation
+	ClosePolicyViolation
+)
+
+func (p RateLimitPolicy) String() string {
+	switch p {
+	case DropMessage:
+		return "drop"
+	case ReplyRateLimited:
+		return "reply-error"
+	case ClosePolicyViolation:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+RateLimitConfig limits how fast clients may send messages.
+
+PerConnection applies to every connection, PerIP is shared by all connections from the same remote address,
+and PerType applies per connection to messages of the given type. A message must pass every configured limit.
+
+The remote address is the TCP peer, so behind a proxy PerIP limits the proxy rather than the end user.
+*/
+type RateLimitConfig struct {
+	PerConnection RateLimit
+	PerIP         RateLimit
+	PerType       map[string]RateLimit
+	Policy        RateLimitPolicy
+}
+
+var errRateLimited = NewError(CodeRateLimited, "rate limit exceeded")
+
+/*
+RateLimit limits how fast each client can send messages. Violations are counted in the server stats.
+
+	wsServer := server.New("8080").EnableAll().ReadLimit(64 << 10).RateLimit(websockets.RateLimitConfig{
+		PerConnection: websockets.RateLimit{Rate: 20, Burst: 40},
+		PerIP:         websockets.RateLimit{Rate: 100, Burst: 200},
+		PerType: map[string]websockets.RateLimit{
+			"broadcast": {Rate: 1, Burst: 5},
+		},
+		Policy: websockets.ReplyRateLimited,
+	})
+*/
+func (s *WsServer) RateLimit(config RateLimitConfig) *WsServer {
+	s.rateLimit = config
+	return s
+}
+
+/*
+ReadLimit sets the maximum size in bytes of a message read from a client.
+
+Larger messages close the connection with websocket.CloseMessageTooBig. Zero, the default, disables the limit.
+*/
+func (s *WsServer) ReadLimit(limit int64) *WsServer {
+	s.readLimit = limit
+	return s
+}
+
+// tokenBucket refills at rate tokens per second up to burst tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	return allowAll(now, b)
+}
+
+// refill adds the tokens earned since the last call, b.mu must be held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allowAll takes a token from every bucket only if each has one available, nil buckets do not limit
+func allowAll(now time.Time, buckets ...*tokenBucket) bool {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.refill(now); b.tokens < 1 {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
+
+// clientLimiter holds the buckets of one Client, it is only used by the Client's read loop
+type clientLimiter struct {
+	conn    *tokenBucket
+	ip      *tokenBucket
+	perType map[string]RateLimit
+	types   map[string]*tokenBucket
+}
+
+// allowFrame checks the connection and IP limits, a rejected frame does not use up either
+func (l *clientLimiter) allowFrame() bool {
+	if l == nil {
+		return true
+	}
+	// The connection bucket is only used by this Client, so locking it before the shared IP bucket cannot deadlock
+	return allowAll(time.Now(), l.conn, l.ip)
+}
+
+// allowType checks the limit for the message type
+func (l *clientLimiter) allowType(msgType string) bool {
+	if l == nil {
+		return true
+	}
+	limit, ok := l.perType[msgType]
+	if !ok || !limit.enabled() {
+		return true
+	}
+	bucket, ok := l.types[msgType]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		l.types[msgType] = bucket
+	}
+	return bucket.allow(time.Now())
+}
+
+// ipBucket is a PerIP bucket shared by the connections from one address
+type ipBucket struct {
+	bucket  *tokenBucket
+	clients int
+}
+
+// newLimiter creates the Client's limiter, returning nil when rate limiting is disabled
+func (s *WsServer) newLimiter(client *Client) *clientLimiter {
+	config := s.rateLimit
+	if !config.PerConnection.enabled() && !config.PerIP.enabled() && len(config.PerType) == 0 {
+		return nil
+	}
+
+	limiter := &clientLimiter{perType: config.PerType, types: make(map[string]*tokenBucket)}
+	if config.PerConnection.enabled() {
+		limiter.conn = newTokenBucket(config.PerConnection)
+	}
+	if config.PerIP.enabled() {
+		client.ip = remoteIP(client.Conn.RemoteAddr().String())
+		s.ipLimitsMu.Lock()
+		entry, ok := s.ipLimits[client.ip]
+		if !ok {
+			entry = &ipBucket{bucket: newTokenBucket(config.PerIP)}
+			s.ipLimits[client.ip] = entry
+		}
+		entry.clients++
+		s.ipLimitsMu.Unlock()
+		limiter.ip = entry.bucket
+	}
+	return limiter
+}
+
+// releaseLimiter forgets the IP bucket once the last connection from the address is removed
+func (s *WsServer) releaseLimiter(client *Client) {
+	if client.limiter == nil || client.limiter.ip == nil {
+		return
+	}
+	s.ipLimitsMu.Lock()
+	defer s.ipLimitsMu.Unlock()
+	if entry, ok := s.ipLimits[client.ip]; ok {
+		if entry.clients--; entry.clients <= 0 {
+			delete(s.ipLimits, client.ip)
+		}
+	}
+}
+
+// remoteIP is the address the PerIP rate limits and the MaxPerIP admission limit are keyed by. It is the IP of the
+// TCP peer, so behind a proxy these limits apply to the proxy rather than the end user.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rateLimitExceeded counts the violation and applies the policy, returning the error to reply with if any
+func (s *WsServer) rateLimitExceeded(client *Client, msgType string) error {
+	s.counter.IncrementRateLimited()
+	if s.debugEnabled() {
+		log.Printf("Rate limited %q from %s", msgType, client.Conn.RemoteAddr())
+	}
+
+	switch s.rateLimit.Policy {
+	case ReplyRateLimited:
+		return errRateLimited
+	case ClosePolicyViolation:
+		client.disconnect(websocket.ClosePolicyViolation, "rate limit exceeded")
+	}
+	return nil
+}
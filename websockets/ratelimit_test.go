@@ -0,0 +1,109 @@
+package websockets
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	now := b.last
+	if !b.allow(now) || !b.allow(now) || b.allow(now) {
+		t.Fatalf("burst of 2 not enforced")
+	}
+	if !b.allow(now.Add(100 * time.Millisecond)) {
+		t.Fatalf("bucket did not refill")
+	}
+}
+
+func TestAllowFrameTakesFromBothOrNeither(t *testing.T) {
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+	ip := newTokenBucket(limit)
+	first := &clientLimiter{conn: newTokenBucket(limit), ip: ip}
+	second := &clientLimiter{conn: newTokenBucket(limit), ip: ip}
+
+	if !first.allowFrame() {
+		t.Fatalf("first frame was limited")
+	}
+	// The shared IP bucket is empty, so the second connection's frame is rejected without using its own token
+	if second.allowFrame() {
+		t.Fatalf("frame over the PerIP limit was allowed")
+	}
+	if second.conn.tokens != 1 {
+		t.Fatalf("rejected frame took a PerConnection token, %v left", second.conn.tokens)
+	}
+}
+
+func TestRateLimitReplyError(t *testing.T) {
+	s := New("0").EnableAll().RateLimit(RateLimitConfig{
+		PerType: map[string]RateLimit{"healthcheck": {Rate: 0.001, Burst: 1}},
+		Policy:  ReplyRateLimited,
+	})
+	conn := dialTestServer(t, s)
+
+	for i := 0; i < 2; i++ {
+		conn.WriteJSON(Envelope{Type: "healthcheck", ID: "h"})
+	}
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "healthcheck" {
+		t.Fatalf("first message = %+v, %v", env, err)
+	}
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "error" || !strings.Contains(string(env.Payload), "rate_limited") {
+		t.Fatalf("second message = %+v %s, %v", env, env.Payload, err)
+	}
+	if got := atomic.LoadInt64(&s.counter.totalRateLimited); got != 1 {
+		t.Fatalf("rate limited = %d", got)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	s := New("0").EnableAll().RateLimit(RateLimitConfig{
+		PerConnection: RateLimit{Rate: 0.001, Burst: 1},
+		Policy:        ClosePolicyViolation,
+	})
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "healthcheck"})
+	conn.WriteJSON(Envelope{Type: "healthcheck"})
+	conn.ReadJSON(&Envelope{})
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("ReadMessage = %v, want close 1008", err)
+	}
+}
+
+func TestRateLimitUndecodableFrames(t *testing.T) {
+	s := New("0").EnableAll().RateLimit(RateLimitConfig{
+		PerConnection: RateLimit{Rate: 0.001, Burst: 2},
+		Policy:        ReplyRateLimited,
+	})
+	conn := dialTestServer(t, s)
+
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	}
+	for i, want := range []string{"invalid_message", "invalid_message", "rate_limited"} {
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil || env.Type != "error" || !strings.Contains(string(env.Payload), want) {
+			t.Fatalf("message %d = %+v %s, %v, want %s", i, env, env.Payload, err, want)
+		}
+	}
+	if got := atomic.LoadInt64(&s.counter.totalRateLimited); got != 1 {
+		t.Fatalf("rate limited = %d", got)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	s := New("0").EnableAll().ReadLimit(64)
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "echo", Payload: []byte(`"` + strings.Repeat("x", 100) + `"`)})
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("ReadMessage = %v, want close 1009", err)
+	}
+}
@@ -0,0 +1,204 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/*
+RequestHandler handles a message that expects a reply and returns the result sent back to the client.
+
+Returning NoReply{} as the result skips the reply.
+*/
+type RequestHandler func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error)
+
+// RequestOption configures a single request handler
+type RequestOption func(*requestConfig)
+
+type requestConfig struct {
+	timeout    time.Duration
+	middleware []Middleware
+}
+
+// WithTimeout overrides the server's RequestTimeout for one handler
+func WithTimeout(timeout time.Duration) RequestOption {
+	return func(c *requestConfig) {
+		c.timeout = timeout
+	}
+}
+
+// WithMiddleware wraps one request handler in middleware, inside the middleware added with Use
+func WithMiddleware(middleware ...Middleware) RequestOption {
+	return func(c *requestConfig) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+const defaultRequestTimeout = 30 * time.Second
+
+/*
+RequestTimeout sets how long request handlers may run before the client receives a timeout error.
+
+The default is 30s. Zero disables the timeout.
+*/
+func (s *WsServer) RequestTimeout(timeout time.Duration) *WsServer {
+	s.requestTimeout = timeout
+	return s
+}
+
+/*
+HandleRequest registers a request/response handler for messages of the given type.
+
+The client correlates replies with the id of its request. A successful result is sent with the
+request's type and id, failures are sent as an error frame with the same id
+
+	-> {"type": "order.create", "id": "17", "payload": {"sku": "A1"}}
+	<- {"type": "order.create", "id": "17", "payload": {"order_id": "o-9"}}
+
+	-> {"type": "order.create", "id": "18", "payload": {}}
+	<- {"type": "error", "id": "18", "payload": {"code": "validation_failed", "message": "sku is required"}}
+
+The ctx passed to the handler is cancelled when the request times out or the client disconnects.
+A handler that overruns its timeout keeps running, but its result is discarded once the
+client has been sent a timeout error. Shutdown still waits for it to return.
+
+	wsServer.HandleRequest("order.create", func(ctx context.Context, client *websockets.Client, msg *websockets.Envelope) (interface{}, error) {
+		var order Order
+		if err := client.Decode(msg.Payload, &order); err != nil {
+			return nil, websockets.NewError(websockets.CodeInvalidPayload, err.Error())
+		}
+		return orders.Create(ctx, order)
+	}, websockets.WithTimeout(5*time.Second))
+*/
+func (s *WsServer) HandleRequest(msgType string, handler RequestHandler, options ...RequestOption) *WsServer {
+	config := requestConfig{timeout: -1}
+	for _, option := range options {
+		option(&config)
+	}
+
+	route := &requestRoute{handler: handler, timeout: config.timeout}
+	entry := &handlerEntry{
+		handler: func(ctx context.Context, client *Client, msg *Envelope) error {
+			result, err := s.runRequest(ctx, client, msg, route)
+			if errors.Is(err, errClientGone) {
+				return err
+			}
+			return s.respond(client, msg, result, err)
+		},
+		middleware: config.middleware,
+		request:    route,
+	}
+
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.handlers[msgType] = entry
+	return s
+}
+
+type requestRoute struct {
+	handler RequestHandler
+	timeout time.Duration
+}
+
+var (
+	errRequestTimeout = NewError(CodeTimeout, "request timed out")
+	errClientGone     = errors.New("client disconnected before the request completed")
+)
+
+type requestOutcome struct {
+	result interface{}
+	err    error
+}
+
+// runRequest runs the handler with the request timeout and returns its result
+func (s *WsServer) runRequest(ctx context.Context, client *Client, msg *Envelope, route *requestRoute) (interface{}, error) {
+	timeout := route.timeout
+	if timeout < 0 {
+		timeout = s.requestTimeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan requestOutcome, 1)
+	abandon := s.detach(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Request handler for %q panicked: %v", msg.Type, r)
+				done <- requestOutcome{err: NewError(CodeInternal, "internal error")}
+			}
+		}()
+		result, err := route.handler(ctx, client, msg)
+		done <- requestOutcome{result: result, err: err}
+	})
+
+	select {
+	case outcome := <-done:
+		if errors.Is(outcome.err, context.DeadlineExceeded) {
+			return nil, errRequestTimeout
+		}
+		return outcome.result, outcome.err
+	case <-ctx.Done():
+		abandon()
+		if client.Context().Err() != nil {
+			// The client is gone, there is nobody to reply to
+			return nil, errClientGone
+		}
+		return nil, errRequestTimeout
+	}
+}
+
+// detach runs the handler in a goroutine its caller may stop waiting for. The caller calls abandon when it returns
+// first, which keeps the handler counted in handlersInFlight until it returns so Shutdown waits for it.
+func (s *WsServer) detach(handler func()) (abandon func()) {
+	const (
+		running int32 = iota
+		finished
+		abandoned
+	)
+	state := running
+	go func() {
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, running, finished) {
+				atomic.AddInt64(&s.handlersInFlight, -1)
+			}
+		}()
+		handler()
+	}()
+
+	return func() {
+		atomic.AddInt64(&s.handlersInFlight, 1)
+		if !atomic.CompareAndSwapInt32(&state, running, abandoned) {
+			// The handler returned meanwhile
+			atomic.AddInt64(&s.handlersInFlight, -1)
+		}
+	}
+}
+
+// respond sends the result of a request, or an error frame if it failed
+func (s *WsServer) respond(client *Client, msg *Envelope, result interface{}, err error) error {
+	if err != nil {
+		return s.replyError(client, msg, err)
+	}
+
+	if _, noReply := result.(NoReply); noReply {
+		return nil
+	}
+
+	env := &Envelope{Type: msg.Type, ID: msg.ID}
+	if result != nil {
+		payload, err := client.Codec.Marshal(result)
+		if err != nil {
+			log.Printf("Failed to marshal the %q response: %v", msg.Type, err)
+			return s.replyError(client, msg, errInternal)
+		}
+		env.Payload = payload
+	}
+	return client.WriteEnvelope(env)
+}
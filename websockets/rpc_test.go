@@ -0,0 +1,110 @@
+package websockets
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleRequestCorrelatesReplies(t *testing.T) {
+	s := New("0")
+	s.HandleRequest("lookup", func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+		var key string
+		if err := client.Decode(msg.Payload, &key); err != nil {
+			return nil, NewError(CodeInvalidPayload, err.Error())
+		}
+		if key != "known" {
+			return nil, NewError(CodeNotFound, key+" does not exist")
+		}
+		return "value", nil
+	})
+	s.HandleRequest("slow", func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, WithTimeout(20*time.Millisecond))
+	conn := dialTestServer(t, s)
+
+	requests := []Envelope{
+		{Type: "lookup", ID: "a", Payload: []byte(`"known"`)},
+		{Type: "lookup", ID: "b", Payload: []byte(`"missing"`)},
+		{Type: "slow", ID: "c"},
+	}
+	for _, req := range requests {
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatalf("WriteJSON: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		"a": `lookup "value"`,
+		"b": `error {"code":"not_found","message":"missing does not exist"}`,
+		"c": `error {"code":"timeout","message":"request timed out"}`,
+	}
+	for range requests {
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		if got := env.Type + " " + string(env.Payload); got != want[env.ID] {
+			t.Errorf("reply %q = %s, want %s", env.ID, got, want[env.ID])
+		}
+	}
+}
+
+func TestRequestClientGone(t *testing.T) {
+	started := make(chan struct{})
+	errs := make(chan error, 4)
+	disconnected := make(chan struct{})
+	s := New("0").
+		OnError(func(client *Client, err error) { errs <- err }).
+		OnDisconnect(func(client *Client, info DisconnectInfo) { close(disconnected) })
+	s.HandleRequest("wait", func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "wait", ID: "1"})
+	<-started
+	conn.Close()
+	<-disconnected
+	select {
+	case err := <-errs:
+		t.Fatalf("OnError = %v, want no error for a request whose client is gone", err)
+	default:
+	}
+}
+
+func TestShutdownWaitsForTimedOutRequests(t *testing.T) {
+	var finished atomic.Bool
+	s := New("0")
+	s.HandleRequest("stubborn", func(ctx context.Context, client *Client, msg *Envelope) (interface{}, error) {
+		// Ignores ctx, so it keeps running once the client was sent a timeout error
+		time.Sleep(200 * time.Millisecond)
+		finished.Store(true)
+		return nil, nil
+	}, WithTimeout(20*time.Millisecond))
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "stubborn", ID: "1"})
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil || env.Type != "error" {
+		t.Fatalf("ReadJSON = %+v, %v, want a timeout error", env, err)
+	}
+	// Answers the close frame
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if report, _ := s.Shutdown(ctx, "maintenance"); !finished.Load() || report.InFlight != 1 {
+		t.Fatalf("Shutdown returned with report %+v before the timed out handler finished", report)
+	}
+}
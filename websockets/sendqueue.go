@@ -0,0 +1,242 @@
+package websockets
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+SlowConsumerPolicy decides what happens when a Client's send queue is full.
+*/
+type SlowConsumerPolicy int
+
+const (
+	// Disconnect closes the connection with websocket.CloseTryAgainLater
+	Disconnect SlowConsumerPolicy = iota
+	// DropOldest discards the oldest queued message to make room for the new one
+	DropOldest
+	// DropNewest discards the message being sent
+	DropNewest
+	// BlockWithTimeout waits up to SendQueueConfig.BlockTimeout for room in the queue, then drops the message
+	BlockWithTimeout
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case Disconnect:
+		return "disconnect"
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case BlockWithTimeout:
+		return "block-with-timeout"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+SendQueueConfig configures the bounded outbound queue each Client is given.
+
+Messages to a Client are queued and written by a dedicated writer goroutine,
+so a slow client never blocks broadcasts to the others.
+*/
+type SendQueueConfig struct {
+	Size         int
+	Policy       SlowConsumerPolicy
+	BlockTimeout time.Duration
+}
+
+var defaultSendQueue = SendQueueConfig{
+	Size:         256,
+	Policy:       Disconnect,
+	BlockTimeout: time.Second,
+}
+
+var (
+	ErrClientClosed  = errors.New("client connection is closed")
+	ErrSendQueueFull = errors.New("client send queue is full")
+	ErrSlowConsumer  = errors.New("client disconnected as a slow consumer")
+)
+
+/*
+SendQueue configures the per Client send queue and the policy applied to slow consumers.
+
+The default is a queue of 256 messages that disconnects clients once it is full.
+
+	wsServer := server.New("8080").EnableAll().SendQueue(websockets.SendQueueConfig{
+		Size:   64,
+		Policy: websockets.DropOldest,
+	})
+*/
+func (s *WsServer) SendQueue(config SendQueueConfig) *WsServer {
+	if config.Size <= 0 {
+		config.Size = defaultSendQueue.Size
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = defaultSendQueue.BlockTimeout
+	}
+	s.sendQueue = config
+	return s
+}
+
+type outbound struct {
+	frameType int
+	data      []byte
+	// closeConn closes the connection once the frame is written instead of waiting for the client to answer
+	closeConn bool
+}
+
+// enqueue adds the frame to the send queue, applying the slow consumer policy when it is full
+func (c *Client) enqueue(frame outbound) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return nil
+	default:
+	}
+
+	switch c.queue.Policy {
+	case DropOldest:
+		for {
+			select {
+			case <-c.send:
+				c.server.counter.IncrementTotalMessagesDropped()
+			default:
+			}
+			select {
+			case c.send <- frame:
+				return nil
+			case <-c.done:
+				return ErrClientClosed
+			default:
+			}
+		}
+
+	case DropNewest:
+		c.server.counter.IncrementTotalMessagesDropped()
+		return ErrSendQueueFull
+
+	case BlockWithTimeout:
+		timer := time.NewTimer(c.queue.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case c.send <- frame:
+			return nil
+		case <-c.done:
+			return ErrClientClosed
+		case <-timer.C:
+			c.server.counter.IncrementTotalMessagesDropped()
+			return ErrSendQueueFull
+		}
+
+	default:
+		c.server.counter.IncrementTotalMessagesDropped()
+		if atomic.CompareAndSwapInt32(&c.slow, 0, 1) {
+			c.server.counter.IncrementSlowConsumers()
+			// The close frame cannot be queued behind the full queue, and writing it must not stall the sender
+			go c.disconnect(websocket.CloseTryAgainLater, "slow consumer")
+		}
+		return ErrSlowConsumer
+	}
+}
+
+// writePump writes queued frames and heartbeat pings to the connection until the Client is closed, and closes
+// it once it is idle
+func (c *Client) writePump() {
+	var pings <-chan time.Time
+	if c.heartbeat.PingInterval > 0 {
+		ticker := time.NewTicker(c.heartbeat.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if c.heartbeat.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(c.heartbeat.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-pings:
+			if !c.ping() {
+				return
+			}
+		case <-idle:
+			// The timer is only moved when it fires, so messages read meanwhile cost nothing
+			if remaining := c.untilIdle(); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			c.closeIdle()
+			return
+		case frame := <-c.send:
+			c.Mu.Lock()
+			c.Conn.SetWriteDeadline(c.writeDeadline())
+			err := c.Conn.WriteMessage(frame.frameType, frame.data)
+			c.Mu.Unlock()
+
+			if errors.Is(err, websocket.ErrCloseSent) {
+				// Shutting down, the read loop ends when the client answers the close frame
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to write message: %v", err)
+				c.Conn.Close()
+				return
+			}
+			if frame.frameType == websocket.CloseMessage {
+				if frame.closeConn {
+					c.Conn.Close()
+				}
+				return
+			}
+			c.server.counter.IncrementTotalMessagesSent()
+			atomic.AddInt64(&c.messagesSent, 1)
+			c.server.counter.AddBytesSent(len(frame.data))
+		}
+	}
+}
+
+// disconnect sends a close frame and closes the connection, which ends the read loop for the Client
+func (c *Client) disconnect(code int, reason string) {
+	c.closing(code, reason)
+	deadline := time.Now().Add(time.Second)
+	if err := c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil {
+		log.Printf("Failed to send close frame: %v", err)
+	}
+	c.Conn.Close()
+}
+
+// disconnectAfterQueued closes the connection like disconnect once the messages already queued are written
+func (c *Client) disconnectAfterQueued(code int, reason string) {
+	c.closing(code, reason)
+	frame := outbound{frameType: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, reason), closeConn: true}
+	select {
+	case c.send <- frame:
+	default:
+		c.disconnect(code, reason)
+	}
+}
+
+// stop ends the writer goroutine and closes the connection
+func (c *Client) stop() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
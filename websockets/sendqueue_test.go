@@ -0,0 +1,102 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stalledClient returns a Client whose writer goroutine is not running, so its queue only fills up
+func stalledClient(policy SlowConsumerPolicy) *Client {
+	s := New("0")
+	return &Client{
+		server: s,
+		queue:  SendQueueConfig{Size: 2, Policy: policy, BlockTimeout: 10 * time.Millisecond},
+		send:   make(chan outbound, 2),
+		done:   make(chan struct{}),
+	}
+}
+
+func queued(c *Client) []string {
+	var frames []string
+	for len(c.send) > 0 {
+		frames = append(frames, string((<-c.send).data))
+	}
+	return frames
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy  SlowConsumerPolicy
+		wantErr error
+		want    []string
+	}{
+		{DropOldest, nil, []string{"2", "3"}},
+		{DropNewest, ErrSendQueueFull, []string{"1", "2"}},
+		{BlockWithTimeout, ErrSendQueueFull, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			c := stalledClient(tt.policy)
+			for _, frame := range []string{"1", "2"} {
+				if err := c.enqueue(outbound{data: []byte(frame)}); err != nil {
+					t.Fatalf("enqueue %s: %v", frame, err)
+				}
+			}
+
+			if err := c.enqueue(outbound{data: []byte("3")}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("enqueue on full queue returned %v, want %v", err, tt.wantErr)
+			}
+			if got := queued(c); len(got) != 2 || got[0] != tt.want[0] || got[1] != tt.want[1] {
+				t.Fatalf("queued %v, want %v", got, tt.want)
+			}
+			if c.server.counter.totalMessagesDropped != 1 {
+				t.Fatalf("dropped %d messages, want 1", c.server.counter.totalMessagesDropped)
+			}
+		})
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	s := New("0").SendQueue(SendQueueConfig{Size: 1})
+	errs := make(chan error, 1)
+	s.HandleFunc("flood", func(ctx context.Context, client *Client, msg *Envelope) error {
+		// Holding the write lock stalls the writer goroutine, so the queue fills up
+		client.Mu.Lock()
+		defer client.Mu.Unlock()
+
+		start := time.Now()
+		var err error
+		for i := 0; i < 3 && err == nil; i++ {
+			err = client.Send("flood", i)
+		}
+		// Sending to a slow consumer neither waits for it nor disconnects it twice
+		client.Send("flood", "again")
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			err = fmt.Errorf("sending took %s", elapsed)
+		}
+		errs <- err
+		return nil
+	})
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Envelope{Type: "flood"})
+	if err := <-errs; !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("Send = %v, want ErrSlowConsumer", err)
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				t.Fatalf("ReadMessage = %v, want close 1013", err)
+			}
+			break
+		}
+	}
+	if stats := s.Stats(); stats.SlowConsumers != 1 {
+		t.Fatalf("SlowConsumers = %d, want 1", stats.SlowConsumers)
+	}
+}
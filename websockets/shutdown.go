@@ -0,0 +1,149 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+ShutdownReport describes how the connections were closed by Shutdown.
+*/
+type ShutdownReport struct {
+	// Connections is the number of connections open during the shutdown
+	Connections int
+	// Closed connections completed the close handshake before the deadline
+	Closed int
+	// ForceClosed connections were still open at the deadline and were closed without waiting
+	ForceClosed int
+	// InFlight is the number of handlers running when the shutdown started
+	InFlight int64
+	// Abandoned is the number of handlers still running when the connections were force closed
+	Abandoned int64
+	Duration  time.Duration
+}
+
+func (r ShutdownReport) String() string {
+	return fmt.Sprintf("%d connections: %d closed, %d force closed; %d handlers in flight, %d abandoned; took %s",
+		r.Connections, r.Closed, r.ForceClosed, r.InFlight, r.Abandoned, r.Duration)
+}
+
+// ErrShuttingDown is returned for upgrades and messages received once Shutdown has started
+var ErrShuttingDown = errors.New("server is shutting down")
+
+/*
+Shutdown drains the server.
+
+New upgrades are rejected with 503 Service Unavailable and messages received from now on are answered with
+an unavailable error, or a JSONRPCServerError for JSON-RPC requests. Once the handlers already running return,
+every client is sent a close frame with websocket.CloseGoingAway and the reason, after the messages queued for it.
+Connections still open when ctx is done are closed without waiting.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := wsServer.Shutdown(ctx, "deploying a new version")
+	log.Printf("Shutdown: %s", report)
+
+The error is the error of shutting down the HTTP server started by Start, if any.
+*/
+func (s *WsServer) Shutdown(ctx context.Context, reason string) (ShutdownReport, error) {
+	start := time.Now()
+	atomic.StoreInt32(&s.draining, 1)
+
+	// Closes the listener right away. Hijacked websocket connections are not tracked by the HTTP server.
+	httpDone := make(chan error, 1)
+	if s.httpServer != nil {
+		go func() { httpDone <- s.httpServer.Shutdown(ctx) }()
+	} else {
+		httpDone <- nil
+	}
+
+	report := ShutdownReport{InFlight: atomic.LoadInt64(&s.handlersInFlight)}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.handlersInFlight) > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	// Taken once the handlers return, so it includes upgrades that were already past rejectDraining
+	clients := s.clients()
+	closing := make(map[*Client]struct{}, len(clients))
+	for _, client := range clients {
+		closing[client] = struct{}{}
+		client.closeGoingAway(ctx, reason)
+	}
+
+	// A client is removed once it answers the close frame and its read loop ends
+	for _, client := range clients {
+		select {
+		case <-client.Context().Done():
+		case <-ctx.Done():
+		}
+	}
+
+	// Connections still open are closed without waiting, including any upgraded since the snapshot
+	for _, client := range s.clients() {
+		if _, ok := closing[client]; !ok {
+			clients = append(clients, client)
+			client.disconnect(websocket.CloseGoingAway, reason)
+		}
+		// Clients with a cancelled context answered the close frame, their read loop is removing them
+		if client.Context().Err() == nil {
+			report.ForceClosed++
+		}
+		s.RemoveConnection(client.Conn)
+	}
+	report.Connections = len(clients)
+	report.Closed = report.Connections - report.ForceClosed
+	if report.ForceClosed > 0 {
+		report.Abandoned = atomic.LoadInt64(&s.handlersInFlight)
+	}
+
+	s.cancel()
+	if s.brokerCancel != nil {
+		s.brokerCancel()
+	}
+	report.Duration = time.Since(start)
+	log.Printf("Shutdown: %s", report)
+	s.PrintStats()
+
+	if err := <-httpDone; err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return report, err
+	}
+	return report, nil
+}
+
+func (s *WsServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// rejectDraining answers upgrades attempted during a shutdown
+func (s *WsServer) rejectDraining(w http.ResponseWriter) error {
+	if !s.isDraining() {
+		return nil
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+	return ErrShuttingDown
+}
+
+// closeGoingAway queues a close frame after the pending messages, the connection stays open until the client answers
+func (c *Client) closeGoingAway(ctx context.Context, reason string) {
+	c.closing(websocket.CloseGoingAway, reason)
+	frame := outbound{frameType: websocket.CloseMessage, data: websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)}
+	select {
+	case c.send <- frame:
+	case <-c.done:
+	case <-ctx.Done():
+	}
+}
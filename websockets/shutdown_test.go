@@ -0,0 +1,131 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	s := New("0")
+	s.HandleFunc("slow", func(ctx context.Context, client *Client, msg *Envelope) error {
+		time.Sleep(100 * time.Millisecond)
+		return client.Send("slow", "done")
+	})
+	ts := newTestServer(t, s)
+
+	// The second connection never reads, so it never answers the close frame
+	good, _ := ts.dial(""), ts.dial("")
+
+	good.WriteJSON(Envelope{Type: "slow"})
+	for atomic.LoadInt64(&s.handlersInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	reports := make(chan ShutdownReport, 1)
+	go func() {
+		report, _ := s.Shutdown(ctx, "maintenance")
+		reports <- report
+	}()
+
+	for !s.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	if resp := ts.reject(""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade during shutdown: %v", resp)
+	}
+
+	// The in flight handler finishes and its reply is sent before the close frame
+	var env Envelope
+	if err := good.ReadJSON(&env); err != nil || string(env.Payload) != `"done"` {
+		t.Fatalf("ReadJSON = %+v, %v", env, err)
+	}
+	var closeErr *websocket.CloseError
+	if _, _, err := good.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "maintenance" {
+		t.Fatalf("ReadMessage error = %v, want going away", err)
+	}
+
+	report := <-reports
+	want := ShutdownReport{Connections: 2, Closed: 1, ForceClosed: 1, InFlight: 1, Duration: report.Duration}
+	if report != want {
+		t.Fatalf("report = %+v, want %+v", report, want)
+	}
+	if len(s.clients()) != 0 {
+		t.Fatalf("%d clients left after shutdown", len(s.clients()))
+	}
+}
+
+func TestShutdownClosesLateUpgrades(t *testing.T) {
+	authenticating, draining := make(chan struct{}), make(chan struct{})
+	lateConnected := make(chan struct{})
+	s := New("0").Authenticate(AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		if r.URL.Query().Get("user") == "late" {
+			// Passed rejectDraining before the shutdown, upgraded during it
+			close(authenticating)
+			<-draining
+		}
+		return &Principal{UserID: r.URL.Query().Get("user")}, nil
+	})).OnConnect(func(client *Client, r *http.Request) error {
+		if client.Principal.UserID == "late" {
+			close(lateConnected)
+		}
+		return nil
+	})
+	s.HandleFunc("slow", func(ctx context.Context, client *Client, msg *Envelope) error {
+		<-lateConnected
+		return nil
+	})
+	ts := newTestServer(t, s)
+
+	busy := ts.dial("busy")
+	busy.WriteJSON(Envelope{Type: "slow"})
+	for atomic.LoadInt64(&s.handlersInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	lateConns := make(chan *websocket.Conn, 1)
+	go func() {
+		conn, _, err := ts.connect(ts.userURL("late"), nil)
+		if err != nil {
+			t.Errorf("Dial: %v", err)
+		}
+		lateConns <- conn
+	}()
+	<-authenticating
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reports := make(chan ShutdownReport, 1)
+	go func() {
+		report, _ := s.Shutdown(ctx, "maintenance")
+		reports <- report
+	}()
+	for !s.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	close(draining)
+
+	late := <-lateConns
+	if late == nil {
+		t.FailNow()
+	}
+	for _, conn := range []*websocket.Conn{busy, late} {
+		var closeErr *websocket.CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+			t.Fatalf("ReadMessage error = %v, want going away", err)
+		}
+	}
+	if report := <-reports; report.Connections != 2 || report.Closed != 2 {
+		t.Fatalf("report = %+v, want 2 connections closed", report)
+	}
+	if len(s.clients()) != 0 {
+		t.Fatalf("%d clients left after shutdown", len(s.clients()))
+	}
+}
@@ -0,0 +1,187 @@
+package websockets
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+TLSConfig sets the base tls.Config used by StartTLS, for example to set MinVersion or ClientCAs.
+
+The config is cloned, so it can be shared. StartTLS always serves the certificate files passed to it.
+
+	wsServer := server.New("8443").EnableAll().TLSConfig(&tls.Config{MinVersion: tls.VersionTLS13})
+*/
+func (s *WsServer) TLSConfig(config *tls.Config) *WsServer {
+	s.tlsConfig = config.Clone()
+	return s
+}
+
+/*
+ClientCAs enables mutual TLS, verifying client certificates against the pool.
+
+When required is false clients without a certificate are still accepted. The verified leaf certificate
+is stored on Client.Certificate, and ClientCertificate() can be used as the Authenticator to turn it into a Principal.
+
+	wsServer := server.New("8443").EnableAll().
+		ClientCAs(pool, true).
+		Authenticate(websockets.ClientCertificate())
+*/
+func (s *WsServer) ClientCAs(pool *x509.CertPool, required bool) *WsServer {
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{}
+	}
+	s.tlsConfig.ClientCAs = pool
+	s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if required {
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return s
+}
+
+/*
+StartTLS starts the Web Socket Server on the specified port serving wss://
+
+The certificate and key are reloaded when the files change on disk, so renewed certificates
+are picked up without restarting the server.
+
+	wsServer, err := server.New("8443").EnableAll().StartTLS("server.crt", "server.key")
+	defer wsServer.Stop()
+*/
+func (s *WsServer) StartTLS(certFile, keyFile string) (*WsServer, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return s, err
+	}
+
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	config.GetCertificate = reloader.GetCertificate
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	listener, err := net.Listen("tcp", ":"+s.port)
+	if err != nil {
+		return s, err
+	}
+	s.serve(tls.NewListener(listener, config))
+	return s, nil
+}
+
+/*
+ClientCertificate authenticates clients with the certificate verified during the mutual TLS handshake.
+
+The Principal's UserID is the certificate's common name.
+*/
+func ClientCertificate() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		cert := peerCertificate(r)
+		if cert == nil {
+			return nil, ErrNoCredentials
+		}
+		return &Principal{
+			UserID: cert.Subject.CommonName,
+			Claims: map[string]interface{}{
+				"serial":    cert.SerialNumber.String(),
+				"dns_names": cert.DNSNames,
+				"issuer":    cert.Issuer.CommonName,
+			},
+		}, nil
+	})
+}
+
+// peerCertificate returns the verified client certificate of the request, if any
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certReloadInterval limits how often the certificate files are checked for changes
+var certReloadInterval = time.Second
+
+// certReloader serves the certificate from disk and reloads it when either file is modified
+type certReloader struct {
+	certFile, keyFile string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// modified reports whether either file changed since the certificate was loaded, checking at most once per certReloadInterval
+func (r *certReloader) modified() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < certReloadInterval {
+		return false
+	}
+	r.lastCheck = time.Now()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr != nil || keyErr != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r.modified() {
+		// Keep serving the previous certificate if the new files are incomplete or invalid
+		if err := r.reload(); err != nil {
+			log.Printf("Failed to reload certificate: %v", err)
+		} else {
+			log.Printf("Reloaded certificate %s", r.certFile)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,150 @@
+package websockets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issueCert creates a certificate signed by parent, or a self-signed CA when parent is nil
+func issueCert(t *testing.T, commonName string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writeFiles(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestStartTLSWithClientCertificates(t *testing.T) {
+	ca := issueCert(t, "test-ca", 1, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	dir := t.TempDir()
+	certFile, keyFile := issueCert(t, "localhost", 2, ca).writeFiles(t, dir)
+
+	s := New("0").ClientCAs(pool, true).Authenticate(ClientCertificate())
+	Handle(s, "whoami", func(ctx context.Context, client *Client, req NoReply) (string, error) {
+		return client.Principal.UserID + ":" + client.Certificate.SerialNumber.String(), nil
+	})
+	if _, err := s.StartTLS(certFile, keyFile); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	defer s.Stop()
+	if err := s.BlockUntilReady(); err != nil {
+		t.Fatalf("BlockUntilReady: %v", err)
+	}
+
+	wsURL := "wss://127.0.0.1:" + s.Addr()[strings.LastIndex(s.Addr(), ":")+1:]
+	dial := func(clientCert *testCert) (*websocket.Conn, *tls.ConnectionState, error) {
+		config := &tls.Config{RootCAs: pool}
+		if clientCert != nil {
+			config.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+		}
+		dialer := websocket.Dialer{TLSClientConfig: config}
+		conn, _, err := dialer.Dial(wsURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		state := conn.UnderlyingConn().(*tls.Conn).ConnectionState()
+		return conn, &state, nil
+	}
+
+	if _, _, err := dial(nil); err == nil {
+		t.Fatalf("connected without a client certificate")
+	}
+
+	conn, state, err := dial(issueCert(t, "device-7", 3, ca))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Fatalf("server presented certificate %d, want 2", serial)
+	}
+
+	conn.WriteJSON(Envelope{Type: "whoami"})
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if string(env.Payload) != `"device-7:3"` {
+		t.Fatalf("got identity %s, want device-7:3", env.Payload)
+	}
+
+	// Renew the server certificate on disk and check new handshakes pick it up
+	certReloadInterval = 0
+	defer func() { certReloadInterval = time.Second }()
+	issueCert(t, "localhost", 4, ca).writeFiles(t, dir)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	renewed, state, err := dial(issueCert(t, "device-7", 5, ca))
+	if err != nil {
+		t.Fatalf("Dial after renewal: %v", err)
+	}
+	defer renewed.Close()
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("server presented certificate %d after renewal, want 4", serial)
+	}
+}
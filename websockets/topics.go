@@ -0,0 +1,313 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const topicMetadataKey = "topic"
+
+var (
+	ErrInvalidTopic = errors.New("invalid topic")
+	ErrNoTopic      = errors.New("message has no topic")
+)
+
+/*
+EnableTopics enables the subscribe, unsubscribe and publish message types.
+
+Topics are dot separated names such as "chat.lobby" or "dashboard.cpu.node1".
+
+Subscriptions can use wildcards
+
+  - "*" matches exactly one segment  - "chat.*" matches "chat.lobby" but not "chat.lobby.typing"
+  - ">" matches one or more trailing segments - "dashboard.>" matches "dashboard.cpu.node1"
+
+Clients manage subscriptions with the topic in the Envelope metadata
+
+	{"type": "subscribe", "id": "1", "metadata": {"topic": "chat.*"}}
+	{"type": "unsubscribe", "id": "2", "metadata": {"topic": "chat.*"}}
+	{"type": "publish", "metadata": {"topic": "chat.lobby"}, "payload": "Hello"}
+
+Subscribers receive published messages as
+
+	{"type": "publish", "metadata": {"topic": "chat.lobby"}, "payload": "Hello"}
+*/
+func (s *WsServer) EnableTopics() *WsServer {
+	s.HandleFunc("subscribe", s.SubscribeHandler)
+	s.HandleFunc("unsubscribe", s.UnsubscribeHandler)
+	s.HandleFunc("publish", s.PublishHandler)
+	return s
+}
+
+/*
+Subscribe adds the Client to the subscribers of the topic pattern.
+*/
+func (s *WsServer) Subscribe(client *Client, pattern string) error {
+	joined, err := s.subscribe(client, pattern)
+	if err != nil {
+		return err
+	}
+	if joined {
+		s.presenceJoin(pattern, client)
+	}
+	return nil
+}
+
+// subscribe adds the Client to the subscribers without announcing its presence, joined is false if it already was one
+func (s *WsServer) subscribe(client *Client, pattern string) (joined bool, err error) {
+	if err := validateTopic(pattern, true); err != nil {
+		return false, err
+	}
+
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	_, subscribed := client.topics[pattern]
+	subscribers, ok := s.topics[pattern]
+	if !ok {
+		subscribers = make(map[*Client]struct{})
+		s.topics[pattern] = subscribers
+	}
+	subscribers[client] = struct{}{}
+	client.topics[pattern] = struct{}{}
+	return !subscribed, nil
+}
+
+/*
+Unsubscribe removes the Client from the subscribers of the topic pattern.
+*/
+func (s *WsServer) Unsubscribe(client *Client, pattern string) {
+	s.topicsMu.Lock()
+	_, subscribed := client.topics[pattern]
+	s.unsubscribeLocked(client, pattern)
+	s.topicsMu.Unlock()
+
+	if subscribed {
+		s.presenceLeave(pattern, client)
+	}
+}
+
+// unsubscribeAll removes the Client from every topic it is subscribed to
+func (s *WsServer) unsubscribeAll(client *Client) {
+	s.topicsMu.Lock()
+	patterns := make([]string, 0, len(client.topics))
+	for pattern := range client.topics {
+		patterns = append(patterns, pattern)
+		s.unsubscribeLocked(client, pattern)
+	}
+	s.topicsMu.Unlock()
+
+	for _, pattern := range patterns {
+		s.presenceLeave(pattern, client)
+	}
+}
+
+func (s *WsServer) unsubscribeLocked(client *Client, pattern string) {
+	delete(client.topics, pattern)
+	if subscribers, ok := s.topics[pattern]; ok {
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(s.topics, pattern)
+		}
+	}
+}
+
+/*
+Subscriptions returns the topic patterns the Client is subscribed to.
+*/
+func (s *WsServer) Subscriptions(client *Client) []string {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	patterns := make([]string, 0, len(client.topics))
+	for pattern := range client.topics {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+/*
+Publish sends msg to every Client subscribed to a pattern matching the topic.
+
+The message is marshalled with each subscriber's Codec. Publish returns the number of clients on this
+instance it was delivered to, with a Broker it is also sent to the other instances.
+
+	delivered, err := wsServer.Publish("dashboard.cpu.node1", CPUStats{Usage: 0.42})
+*/
+func (s *WsServer) Publish(topic string, msg interface{}) (int, error) {
+	if err := validateTopic(topic, false); err != nil {
+		return 0, err
+	}
+	delivered := s.publish(topic, func(codec Codec) ([]byte, error) {
+		return codec.Marshal(msg)
+	})
+	s.forward(brokerPublish, topic, func() ([]byte, error) {
+		return json.Marshal(msg)
+	})
+	return delivered, nil
+}
+
+// publish delivers the payload returned by payloadFor to the subscribers of the topic.
+// Payloads are only marshalled once per Codec.
+func (s *WsServer) publish(topic string, payloadFor func(codec Codec) ([]byte, error)) int {
+	metadata := map[string]string{topicMetadataKey: topic}
+	payloads := make(map[string][]byte)
+	var subscribers []*Client
+	if h := s.history; h != nil && h.keeps(topic) {
+		// The history keeps its own map, the loop below adds the Codecs it is missing to payloads
+		encoded := s.encodeAll(payloadFor)
+		for name, payload := range encoded {
+			payloads[name] = payload
+		}
+		// The subscribers are collected with the sequence number, so a client resuming meanwhile receives
+		// the message either live or in its replay
+		h.mu.Lock()
+		metadata[seqMetadataKey] = h.append(topic, encoded)
+		subscribers = s.subscribers(topic)
+		h.mu.Unlock()
+	} else {
+		subscribers = s.subscribers(topic)
+	}
+
+	delivered := 0
+	for _, client := range subscribers {
+		payload, ok := payloads[client.Codec.Name()]
+		if !ok {
+			var err error
+			if payload, err = payloadFor(client.Codec); err != nil {
+				log.Printf("Failed to marshal message for topic %s: %v", topic, err)
+				continue
+			}
+			payloads[client.Codec.Name()] = payload
+		}
+
+		err := client.deliver(&Envelope{
+			Type:     "publish",
+			Payload:  payload,
+			Metadata: metadata,
+		})
+		if err != nil {
+			log.Printf("Failed to publish message to a client: %v", err)
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// subscribers returns the Clients subscribed to a pattern matching the topic without holding the lock while writing
+func (s *WsServer) subscribers(topic string) []*Client {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+
+	seen := make(map[*Client]struct{})
+	var clients []*Client
+	for pattern, subscribers := range s.topics {
+		if !topicMatches(pattern, topic) {
+			continue
+		}
+		for client := range subscribers {
+			if _, ok := seen[client]; !ok {
+				seen[client] = struct{}{}
+				clients = append(clients, client)
+			}
+		}
+	}
+	return clients
+}
+
+func (s *WsServer) SubscribeHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	pattern := msg.Metadata[topicMetadataKey]
+	if s.history != nil {
+		return s.subscribeWithHistory(client, msg, pattern)
+	}
+	if err := s.Subscribe(client, pattern); err != nil {
+		return s.replyError(client, msg, NewError(CodeInvalidTopic, err.Error()))
+	}
+	return s.replyTopic(client, msg, pattern)
+}
+
+func (s *WsServer) UnsubscribeHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	pattern := msg.Metadata[topicMetadataKey]
+	if err := validateTopic(pattern, true); err != nil {
+		return s.replyError(client, msg, NewError(CodeInvalidTopic, err.Error()))
+	}
+	s.Unsubscribe(client, pattern)
+	return s.replyTopic(client, msg, pattern)
+}
+
+func (s *WsServer) PublishHandler(ctx context.Context, client *Client, msg *Envelope) error {
+	topic := msg.Metadata[topicMetadataKey]
+	if err := validateTopic(topic, false); err != nil {
+		return s.replyError(client, msg, NewError(CodeInvalidTopic, err.Error()))
+	}
+
+	s.publish(topic, func(codec Codec) ([]byte, error) {
+		return transcode(msg.Payload, client.Codec, codec)
+	})
+	s.forward(brokerPublish, topic, func() ([]byte, error) {
+		return transcode(msg.Payload, client.Codec, JSONCodec{})
+	})
+	return nil
+}
+
+// replyTopic acknowledges a subscribe or unsubscribe request
+func (s *WsServer) replyTopic(client *Client, msg *Envelope, pattern string) error {
+	return client.WriteEnvelope(&Envelope{
+		Type:     msg.Type,
+		ID:       msg.ID,
+		Metadata: map[string]string{topicMetadataKey: pattern},
+	})
+}
+
+// transcode converts a Payload between Codecs, returning it unchanged when they match
+func transcode(payload []byte, from, to Codec) ([]byte, error) {
+	if len(payload) == 0 || from.Name() == to.Name() {
+		return payload, nil
+	}
+	var v interface{}
+	if err := from.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return to.Marshal(v)
+}
+
+// validateTopic checks that a topic has no empty segments. Wildcards are only valid in subscription patterns.
+func validateTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return ErrNoTopic
+	}
+	segments := strings.Split(topic, ".")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+			return fmt.Errorf("%w %q: empty segment", ErrInvalidTopic, topic)
+		case (segment == "*" || segment == ">") && !pattern:
+			return fmt.Errorf("%w %q: wildcards are only allowed when subscribing", ErrInvalidTopic, topic)
+		case segment == ">" && i != len(segments)-1:
+			return fmt.Errorf("%w %q: '>' must be the last segment", ErrInvalidTopic, topic)
+		}
+	}
+	return nil
+}
+
+// topicMatches reports whether the topic matches the subscription pattern
+func topicMatches(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	topicSegments := strings.Split(topic, ".")
+
+	for i, segment := range patternSegments {
+		if segment == ">" {
+			return len(topicSegments) > i
+		}
+		if i >= len(topicSegments) {
+			return false
+		}
+		if segment != "*" && segment != topicSegments[i] {
+			return false
+		}
+	}
+	return len(patternSegments) == len(topicSegments)
+}
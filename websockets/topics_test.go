@@ -0,0 +1,69 @@
+package websockets
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"chat.lobby", "chat.lobby", true},
+		{"chat.lobby", "chat.other", false},
+		{"chat.*", "chat.lobby", true},
+		{"chat.*", "chat.lobby.typing", false},
+		{"chat.*", "chat", false},
+		{"dashboard.>", "dashboard.cpu", true},
+		{"dashboard.>", "dashboard.cpu.node1", true},
+		{"dashboard.>", "dashboard", false},
+		{"*.cpu.>", "dashboard.cpu.node1", true},
+		{">", "anything.at.all", true},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestPublishIsolatesTopics(t *testing.T) {
+	s := New("0").EnableTopics()
+	chat := dialTestServer(t, s)
+	dashboard := dialTestServer(t, s)
+
+	subscribe := func(conn *websocket.Conn, topic string) {
+		if err := conn.WriteJSON(Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": topic}}); err != nil {
+			t.Fatalf("WriteJSON: %v", err)
+		}
+		var ack Envelope
+		if err := conn.ReadJSON(&ack); err != nil || ack.Type != "subscribe" {
+			t.Fatalf("subscribe ack %+v (%v)", ack, err)
+		}
+	}
+	subscribe(chat, "chat.*")
+	subscribe(dashboard, "dashboard.>")
+
+	if delivered, err := s.Publish("dashboard.cpu.node1", 0.42); err != nil || delivered != 1 {
+		t.Fatalf("Publish delivered %d (%v), want 1", delivered, err)
+	}
+	if err := chat.WriteJSON(Envelope{Type: "publish", Metadata: map[string]string{"topic": "chat.lobby"}, Payload: []byte(`"hi"`)}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var env Envelope
+	if err := dashboard.ReadJSON(&env); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if env.Metadata["topic"] != "dashboard.cpu.node1" || string(env.Payload) != "0.42" {
+		t.Fatalf("dashboard got %+v", env)
+	}
+	if err := chat.ReadJSON(&env); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if env.Metadata["topic"] != "chat.lobby" || string(env.Payload) != `"hi"` {
+		t.Fatalf("chat got %+v", env)
+	}
+}
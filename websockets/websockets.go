@@ -2,11 +2,13 @@ package websockets
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,14 +21,59 @@ type WsServer struct {
 	Upgrader websocket.Upgrader
 
 	httpServer     *http.Server
+	listener       net.Listener
+	ready          chan struct{}
+	tlsConfig      *tls.Config
+	routesMu       sync.RWMutex // guards defaultHandler, routes can be added while serving
 	defaultHandler map[string]http.Handler
-	WSConnHandlers map[string]Handler
+	codecs         map[string]Codec
+	defaultCodec   Codec
 
-	activeClientsMu sync.RWMutex
-	activeClients   map[*Client]struct{}
-	counter         AtomicCounter
+	handlersMu sync.RWMutex
+	handlers   map[string]*handlerEntry
+	middleware []Middleware
 
-	debug bool
+	activeClientsMu sync.RWMutex
+	activeClients   map[*websocket.Conn]*Client
+	clientsByID     map[string]*Client
+	clientsByUser   map[string]map[*Client]struct{}
+	draining        int32
+	// handlersInFlight counts the messages being handled, reported by Shutdown
+	handlersInFlight int64
+	counter          AtomicCounter
+	sendQueue        SendQueueConfig
+	heartbeat        HeartbeatConfig
+	authenticator    Authenticator
+	requestTimeout   time.Duration
+	messageTimeout   time.Duration
+	maxClientErrors  int
+	readLimit        int64
+	rateLimit        RateLimitConfig
+
+	ipLimitsMu sync.Mutex
+	ipLimits   map[string]*ipBucket
+	admission  *admission
+
+	nodeID        string
+	broker        Broker
+	brokerChannel string
+	brokerCancel  context.CancelFunc
+
+	topicsMu sync.RWMutex
+	topics   map[string]map[*Client]struct{}
+	history  *history
+	presence *presence
+
+	directPermission DirectPermission
+	connectHooks     []ConnectHook
+	disconnectHooks  []DisconnectHook
+	errorHooks       []ErrorHook
+
+	// ctx is the parent of the Clients' contexts, cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	debug int32 // accessed atomically
 }
 
 /*
@@ -64,12 +111,24 @@ func New(port string) *WsServer {
 		baseRoute:       "/" + defaultPath,
 		Upgrader:        websocket.Upgrader{},
 		defaultHandler:  make(map[string]http.Handler),
-		WSConnHandlers:  make(map[string]Handler),
+		handlers:        make(map[string]*handlerEntry),
+		middleware:      []Middleware{Recovery()},
+		codecs:          make(map[string]Codec),
+		defaultCodec:    JSONCodec{},
 		activeClientsMu: sync.RWMutex{},
-		activeClients:   make(map[*Client]struct{}),
+		activeClients:   make(map[*websocket.Conn]*Client),
+		clientsByID:     make(map[string]*Client),
+		clientsByUser:   make(map[string]map[*Client]struct{}),
+		topics:          make(map[string]map[*Client]struct{}),
+		ipLimits:        make(map[string]*ipBucket),
+		nodeID:          newID(),
 		counter:         AtomicCounter{},
+		sendQueue:       defaultSendQueue,
+		heartbeat:       defaultHeartbeat,
+		requestTimeout:  defaultRequestTimeout,
 	}
 
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.defaultHandler[s.baseRoute] = http.HandlerFunc(s.RootSocketHandler)
 
 	return s
@@ -97,7 +156,21 @@ This enables us to achieve this following pattern
 		ServeHTTP(http.ResponseWriter, *http.Request)
 */
 func (s *WsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.defaultHandler[s.baseRoute].ServeHTTP(w, r)
+	// Any path without its own handler is the websocket endpoint
+	s.routesMu.RLock()
+	handler, ok := s.defaultHandler[r.URL.Path]
+	if !ok {
+		handler = s.defaultHandler[s.baseRoute]
+	}
+	s.routesMu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// serveHTTPPath serves the handler at the path, next to the websocket endpoint
+func (s *WsServer) serveHTTPPath(path string, handler http.Handler) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	s.defaultHandler[path] = handler
 }
 
 /*
@@ -124,99 +197,147 @@ Optionally - to return the Web Socket Server Instance
 	err := httpServer.ListenAndServe()
 */
 func (s *WsServer) Start() (*WsServer, error) {
+	listener, err := net.Listen("tcp", ":"+s.port) // ":8080"
+	if err != nil {
+		return s, err
+	}
+	s.serve(listener)
+	return s, nil
+}
+
+// serve starts the HTTP Server on the listener in the background, ready is closed once it accepts connections
+func (s *WsServer) serve(listener net.Listener) {
+	ready := make(chan struct{})
+	s.ready = ready
+	s.listener = listener
 	s.httpServer = &http.Server{
-		Addr:    ":" + s.port, // ":8080"
+		Addr:    listener.Addr().String(),
 		Handler: s,
+		// Called by Serve right before it starts accepting
+		BaseContext: func(net.Listener) context.Context {
+			close(ready)
+			return context.Background()
+		},
 	}
 	go func() {
-		err := s.httpServer.ListenAndServe()
+		err := s.httpServer.Serve(listener)
 		if err != nil && err != http.ErrServerClosed {
 			log.Printf("Error starting server: %v", err)
 		}
 	}()
+}
 
-	return s, nil
+/*
+Addr returns the address the server is listening on once it has been started.
+
+This is useful when starting the server on port "0" to pick a random free port.
+*/
+func (s *WsServer) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
 }
 
 /*
-BlockUntilReady - Blocks until the Web Socket Server is ready to accept connections
+BlockUntilReady - Blocks until the Web Socket Server is accepting connections, for up to 10 seconds
 
 Example
 
-	wsServer , err := server.NewWsServer().EnableAll().Insecure().Start()
-	defer wsServer.Stop() // Start() blocks
+	wsServer, err := server.New("0").EnableAll().Insecure().Start()
+	defer wsServer.Stop()
+	wsServer.BlockUntilReady()
 */
 func (s *WsServer) BlockUntilReady() error {
-	maxRetries := 10
-	dialer := websocket.DefaultDialer
-
-	for i := 0; i < maxRetries; i++ {
-		time.Sleep(1 * time.Second) // Wait a second between attempts
-
-		// Try to establish a WebSocket connection
-		conn, _, err := dialer.Dial("ws://localhost:"+s.port+s.baseRoute, nil)
-		defer s.RemoveConnection(conn)
-
-		if err != nil {
-			log.Printf("WebSocket connection attempt %d failed: %v", i+1, err)
-			continue
-		}
-
-		// Send a health check message
-		healthCheckReq := map[string]interface{}{
-			"type": "healthcheck",
-		}
-		err = conn.WriteJSON(healthCheckReq)
-		if err != nil {
-			log.Printf("Failed to send healthcheck message: %v", err)
-			conn.Close()
-			continue
-		}
-
-		log.Println("Health Check Successful!")
+	if s.ready == nil {
+		return errors.New("server has not been started")
+	}
+	select {
+	case <-s.ready:
 		return nil
+	case <-time.After(10 * time.Second):
+		return errors.New("server not ready after 10 seconds")
 	}
-
-	return fmt.Errorf("server not ready after %d attempts", maxRetries)
 }
 
 /*
-Stop - Gracefully stops the Web Socket Server
+Stop - Gracefully stops the Web Socket Server, giving clients 5 seconds to close their connections
+
+Use Shutdown to choose the deadline and get a report of the connections closed.
 */
 func (s *WsServer) Stop() error {
 	log.Printf("Called Stop")
 	if s.httpServer == nil {
 		return errors.New("server has not been started")
 	}
-	s.TerminateConnections()
-
-	s.PrintStats()
 
 	// Create a context with a timeout to allow connections to finish
 	timeoutContext, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := s.httpServer.Shutdown(timeoutContext)
+	_, err := s.Shutdown(timeoutContext, "server stopping")
 	return err
 }
 
 /*
 Insecure
 Allows the Web Socket Server to accept connections from any origin
+
+Use Origins with an OriginPolicy to restrict origins in production.
 */
 func (s *WsServer) Insecure() *WsServer {
 	s.Upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	return s
 }
 
+/*
+Codecs registers additional Codecs that clients can negotiate through the Sec-WebSocket-Protocol header.
+
+JSON is always available and is used when the client does not request a subprotocol.
+
+	wsServer := server.New("8080").EnableAll().Codecs(websockets.MsgPackCodec{}, websockets.ProtobufCodec{})
+*/
+func (s *WsServer) Codecs(codecs ...Codec) *WsServer {
+	for _, codec := range codecs {
+		if _, exists := s.codecs[codec.Name()]; !exists {
+			s.Upgrader.Subprotocols = append(s.Upgrader.Subprotocols, codec.Name())
+		}
+		s.codecs[codec.Name()] = codec
+	}
+	return s
+}
+
+// codecFor returns the Codec negotiated for the subprotocol, defaulting to JSON
+func (s *WsServer) codecFor(subprotocol string) Codec {
+	if codec, ok := s.codecs[subprotocol]; ok {
+		return codec
+	}
+	return s.defaultCodec
+}
+
 /*
 Enable Debugging for the Websocket Server.
 */
 func (s *WsServer) Debug() *WsServer {
-	s.debug = true
+	s.SetDebug(true)
 	return s
 }
 
+/*
+SetDebug turns debugging on or off while the server is running.
+*/
+func (s *WsServer) SetDebug(enabled bool) {
+	var debug int32
+	if enabled {
+		debug = 1
+	}
+	atomic.StoreInt32(&s.debug, debug)
+}
+
+func (s *WsServer) debugEnabled() bool {
+	return atomic.LoadInt32(&s.debug) == 1
+}
+
 /*
 EnableAll enables all the routes that are available in the Web Socket Server
 
@@ -224,30 +345,61 @@ Routes
   - /echo
   - /broadcast
   - /healthcheck
+  - /subscribe , /unsubscribe , /publish
 */
 func (s *WsServer) EnableAll() *WsServer {
 	for _, endpoint := range []string{"echo", "broadcast", "healthcheck"} {
 		switch endpoint {
 		case "healthcheck":
-			s.WSConnHandlers[endpoint] = s.HealthCheckHandler
+			s.HandleFunc(endpoint, s.HealthCheckHandler)
 		case "echo":
-			s.WSConnHandlers[endpoint] = s.EchoHandler
+			s.HandleFunc(endpoint, s.EchoHandler)
 		case "broadcast":
-			s.WSConnHandlers[endpoint] = s.BroadcastHandler
+			s.HandleFunc(endpoint, s.BroadcastHandler)
 		}
 	}
+	s.EnableTopics()
 
 	return s
 }
 
-func (s *WsServer) UpgradeHTTPConntoWebSockets(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+/*
+UpgradeHTTPConntoWebSockets authenticates the request and upgrades it to a websocket connection.
+
+Requests from a rejected origin, rejected by the Authenticator or over an Admission limit receive an HTTP error
+and are never upgraded, as do requests made while the server is shutting down. The origin is checked first, so
+cross-origin requests never reach the Authenticator.
+*/
+func (s *WsServer) UpgradeHTTPConntoWebSockets(w http.ResponseWriter, r *http.Request) (*Client, error) {
+	if err := s.rejectDraining(w); err != nil {
+		return nil, err
+	}
+	if err := s.rejectOrigin(w, r); err != nil {
+		return nil, err
+	}
+	principal, err := s.authenticate(w, r)
+	if err != nil {
+		return nil, err
+	}
+	release, err := s.admit(w, r, principal)
+	if err != nil {
+		return nil, err
+	}
+
 	conn, err := s.Upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Failed to upgrade HTTP to WS")
+		s.counter.IncrementUpgradeFailures()
+		release()
 		return nil, err
 	}
 	log.Print("Successfully Upgraded Connection")
-	s.AddActiveConnection(conn)
+	client := s.newClient(valuesContext{Context: s.ctx, values: r.Context()}, conn, s.codecFor(conn.Subprotocol()))
+	client.Principal = principal
+	client.Certificate = peerCertificate(r)
+	client.Request = r
+	client.release = release
+	s.addClient(client)
 
 	// s.activeClientsMu.Lock()
 	// s.activeClients[conn] = true
@@ -255,32 +407,45 @@ func (s *WsServer) UpgradeHTTPConntoWebSockets(w http.ResponseWriter, r *http.Re
 
 	s.counter.IncrementTotalConnections()
 
-	return conn, nil
+	return client, nil
 }
 
+/*
+TerminateConnections sends every client a close frame and closes its connection without waiting for the reply.
+*/
 func (s *WsServer) TerminateConnections() {
 	log.Println("Terminating Connections")
 
-	var connectionsToRemove []*websocket.Conn
-
-	s.activeClientsMu.Lock()
-	for client := range s.activeClients {
-		connectionsToRemove = append(connectionsToRemove, client.Conn)
-	}
-	s.activeClientsMu.Unlock()
-
-	for client := range s.activeClients {
+	for _, client := range s.clients() {
+		client.disconnect(websocket.CloseGoingAway, "server terminating connections")
 		s.RemoveConnection(client.Conn)
-		// err := client.Conn.Close()
-		// if err != nil {
-		// 	log.Printf("Error closing connection: %v", err)
-		// }
 	}
 	log.Println("Terminated Connections")
 }
 
 func (s *WsServer) PrintStats() {
-	log.Printf("Total Connections: %d", s.counter.totalConnections)
-	log.Printf("Total Messages Sent: %d", s.counter.totalMessagesSent)
-	log.Printf("Total Messages Received: %d", s.counter.totalMessagesReceived)
+	log.Printf("Total Connections: %d", atomic.LoadInt64(&s.counter.totalConnections))
+	log.Printf("Total Messages Sent: %d", atomic.LoadInt64(&s.counter.totalMessagesSent))
+	log.Printf("Total Messages Received: %d", atomic.LoadInt64(&s.counter.totalMessagesReceived))
+	log.Printf("Total Messages Dropped: %d", atomic.LoadInt64(&s.counter.totalMessagesDropped))
+	log.Printf("Total Slow Consumers Disconnected: %d", atomic.LoadInt64(&s.counter.totalSlowConsumers))
+	log.Printf("Total Heartbeat Timeouts: %d", atomic.LoadInt64(&s.counter.totalHeartbeatTimeout))
+	log.Printf("Total Idle Timeouts: %d", atomic.LoadInt64(&s.counter.totalIdleTimeouts))
+	log.Printf("Total Rejected Authentications: %d", atomic.LoadInt64(&s.counter.totalAuthRejections))
+	log.Printf("Total Rejected Origins: %d", atomic.LoadInt64(&s.counter.totalOriginRejections))
+	log.Printf("Total Rate Limited Messages: %d", atomic.LoadInt64(&s.counter.totalRateLimited))
+	log.Printf("Total Oversized Messages: %d", atomic.LoadInt64(&s.counter.totalOversized))
+	log.Printf("Total Rejected Admissions: %d", atomic.LoadInt64(&s.counter.totalAdmissionRejects))
+	log.Printf("Total Client Errors: %d", atomic.LoadInt64(&s.counter.totalClientErrors))
+	for msgType, stats := range s.counter.MessageTypes() {
+		log.Printf("Messages %q: %d handled, %d failed, avg %s, max %s",
+			msgType, stats.Count, stats.Errors, stats.TotalLatency/time.Duration(stats.Count), stats.MaxLatency)
+	}
+}
+
+/*
+MessageStats returns the per message type metrics recorded by the Metrics middleware.
+*/
+func (s *WsServer) MessageStats() map[string]MessageTypeStats {
+	return s.counter.MessageTypes()
 }
@@ -0,0 +1,261 @@
+/*
+Package wstest runs a websockets.WsServer in process for tests and connects clients to it.
+
+	func TestChat(t *testing.T) {
+		srv := wstest.NewServer(t, websockets.New("0").EnableAll())
+		clients := srv.DialN(3)
+
+		clients[0].Send("broadcast", "hello")
+		for _, client := range clients {
+			client.Expect("broadcast", time.Second)
+		}
+		clients[1].ExpectNone(100 * time.Millisecond)
+
+		clients[2].Drop()
+		srv.ExpectConnections(2, time.Second)
+	}
+
+Clients speak the default JSON codec.
+*/
+package wstest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kuro337/golibs/websockets"
+)
+
+/*
+Server is a WsServer listening on a random local port.
+*/
+type Server struct {
+	Server *websockets.WsServer
+	HTTP   *httptest.Server
+	// URL is the ws:// URL of the websocket endpoint
+	URL string
+
+	t testing.TB
+}
+
+/*
+NewServer serves s on an httptest.Server. The server is shut down when the test ends.
+*/
+func NewServer(t testing.TB, s *websockets.WsServer) *Server {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx, "test finished")
+		ts.Close()
+	})
+	return &Server{Server: s, HTTP: ts, URL: "ws" + strings.TrimPrefix(ts.URL, "http"), t: t}
+}
+
+/*
+Dial connects a Client to the websocket endpoint, failing the test if the upgrade fails.
+*/
+func (s *Server) Dial() *Client {
+	s.t.Helper()
+	return s.DialWith("", nil)
+}
+
+/*
+DialN connects n Clients.
+*/
+func (s *Server) DialN(n int) []*Client {
+	s.t.Helper()
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = s.Dial()
+	}
+	return clients
+}
+
+/*
+DialWith connects a Client with the path and query, such as "/?token=abc", and the request header.
+*/
+func (s *Server) DialWith(pathAndQuery string, header http.Header) *Client {
+	s.t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(s.URL+pathAndQuery, header)
+	if err != nil {
+		if resp != nil {
+			s.t.Fatalf("wstest: dial %s: %v (HTTP %d)", pathAndQuery, err, resp.StatusCode)
+		}
+		s.t.Fatalf("wstest: dial %s: %v", pathAndQuery, err)
+	}
+	client := &Client{Conn: conn, t: s.t, messages: make(chan websockets.Envelope, 256), done: make(chan struct{})}
+	go client.read()
+	s.t.Cleanup(func() { conn.Close() })
+	return client
+}
+
+/*
+ExpectConnections waits until the server has n active connections, failing the test after the timeout.
+*/
+func (s *Server) ExpectConnections(n int, timeout time.Duration) {
+	s.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		active := s.Server.Stats().ActiveConnections
+		if active == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("wstest: %d active connections after %s, want %d", active, timeout, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+/*
+Client is a test connection. Messages are read in the background and consumed in order by the Expect methods.
+*/
+type Client struct {
+	Conn *websocket.Conn
+
+	t        testing.TB
+	messages chan websockets.Envelope
+	done     chan struct{}
+	// err ends the reader, it is set before done is closed
+	err error
+}
+
+func (c *Client) read() {
+	defer close(c.done)
+	for {
+		_, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var env websockets.Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			c.err = err
+			return
+		}
+		c.messages <- env
+	}
+}
+
+/*
+Send sends a message of the given type with the payload marshalled as JSON.
+*/
+func (c *Client) Send(msgType string, payload interface{}) {
+	c.t.Helper()
+	env := websockets.Envelope{Type: msgType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			c.t.Fatalf("wstest: marshal %s payload: %v", msgType, err)
+		}
+		env.Payload = data
+	}
+	c.SendEnvelope(env)
+}
+
+/*
+SendEnvelope sends the Envelope, to set an ID or metadata.
+*/
+func (c *Client) SendEnvelope(env websockets.Envelope) {
+	c.t.Helper()
+	if err := c.Conn.WriteJSON(env); err != nil {
+		c.t.Fatalf("wstest: send %s: %v", env.Type, err)
+	}
+}
+
+/*
+Next returns the next message, failing the test if none arrives within the timeout.
+*/
+func (c *Client) Next(timeout time.Duration) websockets.Envelope {
+	c.t.Helper()
+	select {
+	case env := <-c.messages:
+		return env
+	case <-c.done:
+		// Messages read before the connection closed are still delivered
+		select {
+		case env := <-c.messages:
+			return env
+		default:
+		}
+		c.t.Fatalf("wstest: connection closed while waiting for a message: %v", c.err)
+	case <-time.After(timeout):
+		c.t.Fatalf("wstest: no message within %s", timeout)
+	}
+	return websockets.Envelope{}
+}
+
+/*
+Expect returns the next message, failing the test if it is not of the given type or none arrives within the timeout.
+*/
+func (c *Client) Expect(msgType string, timeout time.Duration) websockets.Envelope {
+	c.t.Helper()
+	env := c.Next(timeout)
+	if env.Type != msgType {
+		c.t.Fatalf("wstest: got %s message %s, want %s", env.Type, env.Payload, msgType)
+	}
+	return env
+}
+
+/*
+ExpectPayload is Expect that also decodes the JSON payload into v.
+*/
+func (c *Client) ExpectPayload(msgType string, timeout time.Duration, v interface{}) websockets.Envelope {
+	c.t.Helper()
+	env := c.Expect(msgType, timeout)
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		c.t.Fatalf("wstest: decode %s payload %s: %v", msgType, env.Payload, err)
+	}
+	return env
+}
+
+/*
+ExpectNone fails the test if a message arrives within the duration.
+*/
+func (c *Client) ExpectNone(within time.Duration) {
+	c.t.Helper()
+	select {
+	case env := <-c.messages:
+		c.t.Fatalf("wstest: got unexpected %s message %s", env.Type, env.Payload)
+	case <-time.After(within):
+	}
+}
+
+/*
+ExpectClose waits for the server to close the connection with the close code, failing the test otherwise.
+Messages that were not consumed are discarded.
+*/
+func (c *Client) ExpectClose(code int, timeout time.Duration) {
+	c.t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+		c.t.Fatalf("wstest: connection not closed within %s", timeout)
+	}
+	if !websocket.IsCloseError(c.err, code) {
+		c.t.Fatalf("wstest: connection closed with %v, want close code %d", c.err, code)
+	}
+}
+
+/*
+Close closes the connection normally with a close frame.
+*/
+func (c *Client) Close() {
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+/*
+Drop closes the TCP connection without a close frame, like a client losing its network.
+*/
+func (c *Client) Drop() {
+	c.Conn.UnderlyingConn().Close()
+}
@@ -0,0 +1,37 @@
+package wstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kuro337/golibs/websockets"
+	"github.com/kuro337/golibs/websockets/wstest"
+)
+
+func TestServer(t *testing.T) {
+	srv := wstest.NewServer(t, websockets.New("0").EnableAll().MaxClientErrors(1))
+	clients := srv.DialN(3)
+	srv.ExpectConnections(3, time.Second)
+
+	clients[0].Send("broadcast", "hello")
+	for _, client := range clients {
+		var message string
+		if client.ExpectPayload("broadcast", time.Second, &message); message != "hello" {
+			t.Fatalf("broadcast = %q", message)
+		}
+	}
+
+	clients[1].SendEnvelope(websockets.Envelope{Type: "subscribe", ID: "1", Metadata: map[string]string{"topic": "news"}})
+	clients[1].Expect("subscribe", time.Second)
+	srv.Server.Publish("news", "extra")
+	clients[1].Expect("publish", time.Second)
+	clients[0].ExpectNone(50 * time.Millisecond)
+
+	clients[2].Drop()
+	srv.ExpectConnections(2, time.Second)
+
+	clients[0].Send("unknown", nil)
+	clients[0].Expect("error", time.Second)
+	clients[0].ExpectClose(websocket.ClosePolicyViolation, time.Second)
+}